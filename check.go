@@ -0,0 +1,77 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/szampardi/xprint/temple"
+)
+
+// xprint check [flags] [FILE...]
+func check(context.Context) error {
+	templates, err := commandlineTemplates(data.Args)
+	if err != nil {
+		return err
+	}
+	problems := engine.Check(templates)
+	if *jsonOutput {
+		if problems == nil {
+			problems = []temple.Problem{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(problems); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range problems {
+			where := p.Position
+			if where == "" {
+				where = p.Name
+			}
+			fmt.Printf("%s: %s: %s: %s\n", where, p.Severity, p.Kind, p.Message)
+		}
+	}
+	failed := 0
+	for _, p := range problems {
+		if p.Severity != temple.SeverityWarning {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d problem(s) found", failed)
+	}
+	return nil
+}
+
+// commandlineTemplates collects the templates given with -t and -f in order, and more template files
+func commandlineTemplates(files []string) ([]temple.Template, error) {
+	var out []temple.Template
+	for n, t := range _templates {
+		if !t.IsFile {
+			if len(t.S) > 0 {
+				out = append(out, temple.Template{Name: fmt.Sprintf("opt%d", n), Text: t.S})
+			}
+			continue
+		}
+		loaded, err := engine.Load(t.S)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, loaded...)
+	}
+	loaded, err := engine.Load(files...)
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, loaded...)
+	if len(out) < 1 {
+		return nil, fmt.Errorf("no templates given")
+	}
+	return out, nil
+}
@@ -0,0 +1,86 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/szampardi/xprint/temple"
+)
+
+var (
+	lastRender *[sha256.Size]byte
+	appendedTo []byte // the output file before the first render in append mode, it ends with the previous one
+)
+
+// seedLastRender takes the current content of the output file as the last render, or its end in append mode,
+// so the first one only runs the -x command if it changes the file
+func seedLastRender() {
+	if *execCmd == "" || outputPath == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(outputPath)
+	if err != nil {
+		return
+	}
+	if writeOpts.Mode == "" || writeOpts.Mode == temple.WriteAppend {
+		appendedTo = b
+		return
+	}
+	sum := sha256.Sum256(b)
+	lastRender = &sum
+}
+
+// afterRender runs the -x command with sh if the output differs from the last one, returning its exit code:
+// 124 if it timed out and 128+N if it was killed by signal N, like sh does
+func afterRender(ctx context.Context, written []byte) int {
+	if *execCmd == "" {
+		return 0
+	}
+	sum := sha256.Sum256(written)
+	unchanged := lastRender != nil && *lastRender == sum
+	if appendedTo != nil {
+		unchanged = bytes.HasSuffix(appendedTo, written)
+		appendedTo = nil
+	}
+	lastRender = &sum
+	if unchanged {
+		l.Infof("output unchanged, not running %q", *execCmd)
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(ctx, *execTimeout)
+	defer cancel()
+	c := exec.CommandContext(ctx, "/bin/sh", "-c", *execCmd)
+	c.Stdout = os.Stderr
+	c.Stderr = os.Stderr
+	err := c.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		l.Errorf("%q timed out after %s", *execCmd, *execTimeout)
+		return 124
+	case ctx.Err() != nil:
+		l.Errorf("%q interrupted", *execCmd)
+		return 130
+	case errors.As(err, &exitErr):
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			l.Errorf("%q killed by %s", *execCmd, status.Signal())
+			return 128 + int(status.Signal())
+		}
+		l.Errorf("%q exited with code %d", *execCmd, exitErr.ExitCode())
+		return exitErr.ExitCode()
+	case err != nil:
+		l.Errorf("running %q: %s", *execCmd, err)
+		return 127
+	}
+	l.Noticef("%q exited with code 0", *execCmd)
+	return 0
+}
@@ -0,0 +1,78 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/szampardi/msg"
+	"github.com/szampardi/xprint/temple"
+)
+
+// quietLogger sets l to a logger writing nowhere, for the tests of what logs through it
+func quietLogger(t *testing.T) {
+	var err error
+	if l, err = log.New(log.Formats[log.PlainFormat].String(), log.Formats[log.DefTimeFmt].String(), log.LDebug, false, "test", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAfterRender(t *testing.T) {
+	quietLogger(t)
+	defer func(cmd string, timeout time.Duration) { *execCmd, *execTimeout = cmd, timeout }(*execCmd, *execTimeout)
+	*execTimeout = 100 * time.Millisecond
+	cases := []struct {
+		name    string
+		cmd     string
+		renders []string
+		want    []int // the exit code after each render
+	}{
+		{"success", "true", []string{"a"}, []int{0}},
+		{"exit status", "exit 7", []string{"a"}, []int{7}},
+		{"timeout", "exec sleep 5", []string{"a"}, []int{124}},
+		{"signal", "kill -TERM $$", []string{"a"}, []int{143}},
+		{"not run when unchanged", "exit 3", []string{"a", "a", "b"}, []int{3, 0, 3}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			*execCmd, lastRender, appendedTo = c.cmd, nil, nil
+			for i, r := range c.renders {
+				if code := afterRender(context.Background(), []byte(r)); code != c.want[i] {
+					t.Fatalf("render %d: expected exit code %d, got %d", i, c.want[i], code)
+				}
+			}
+		})
+	}
+}
+
+func TestAfterRenderSeeded(t *testing.T) {
+	quietLogger(t)
+	defer func(cmd, path string, opts temple.WriteOptions) { *execCmd, outputPath, writeOpts = cmd, path, opts }(*execCmd, outputPath, writeOpts)
+	*execCmd, outputPath = "exit 3", filepath.Join(t.TempDir(), "out")
+	if err := ioutil.WriteFile(outputPath, []byte("old\nnew\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		mode   string
+		render string
+		want   int
+	}{
+		{temple.WriteAppend, "new\n", 0},
+		{temple.WriteAppend, "newer\n", 3},
+		{temple.WriteTruncate, "old\nnew\n", 0},
+		{temple.WriteTruncate, "new\n", 3},
+		{temple.WriteAtomic, "old\nnew\n", 0},
+	}
+	for _, c := range cases {
+		writeOpts.Mode, lastRender, appendedTo = c.mode, nil, nil
+		seedLastRender()
+		if code := afterRender(context.Background(), []byte(c.render)); code != c.want {
+			t.Errorf("%s %q: expected exit code %d, got %d", c.mode, c.render, c.want, code)
+		}
+	}
+}
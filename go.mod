@@ -3,6 +3,7 @@ module github.com/szampardi/xprint
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v0.4.1
 	github.com/szampardi/msg v2.4.0+incompatible
 	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
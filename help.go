@@ -0,0 +1,37 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/szampardi/xprint/temple"
+)
+
+// xprint -H [-hf FORMAT] [NAME|PATTERN|CATEGORY...]
+func showFunctions(patterns []string) error {
+	fns := functions.Filter(patterns...)
+	if len(fns) < 1 {
+		return fmt.Errorf("no functions match %s", strings.Join(patterns, ", "))
+	}
+	format := *helpFormat
+	if format == "" {
+		format = temple.HelpTable
+		if len(patterns) > 0 && allFunctionNames(patterns) {
+			format = temple.HelpDetail
+		}
+	}
+	return fns.WriteHelp(os.Stderr, format)
+}
+
+func allFunctionNames(names []string) bool {
+	for _, name := range names {
+		if _, ok := functions[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/szampardi/xprint/temple"
+)
+
+// xprint inspect [flags] [FILE...]
+func inspect(context.Context) error {
+	templates, err := commandlineTemplates(data.Args)
+	if err != nil {
+		return err
+	}
+	report, problems := engine.Inspect(templates)
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "FUNCTIONS")
+		for _, f := range report.Functions {
+			var notes []string
+			if f.Unsafe {
+				notes = append(notes, "UNSAFE")
+			}
+			if !f.Defined {
+				notes = append(notes, "UNDEFINED")
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", f.Name, strings.Join(notes, ","), strings.Join(f.Positions, " "))
+		}
+		for _, section := range []struct {
+			title string
+			uses  []temple.LiteralUse
+		}{
+			{"FILES", report.Files},
+			{"URLS", report.URLs},
+			{"COMMANDS", report.Commands},
+			{"ENV", report.Env},
+		} {
+			if len(section.uses) < 1 {
+				continue
+			}
+			fmt.Fprintln(tw, section.title)
+			for _, u := range section.uses {
+				fmt.Fprintf(tw, "  %s\t%s\t%s\n", u.Function, strings.Join(u.Args, " "), u.Position)
+			}
+		}
+		if len(report.Fields) > 0 {
+			fmt.Fprintln(tw, "FIELDS")
+			for _, f := range report.Fields {
+				fmt.Fprintf(tw, "  %s\n", f)
+			}
+		}
+		if err = tw.Flush(); err != nil {
+			return err
+		}
+	}
+	for _, p := range problems {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", p.Kind, p.Message)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d template(s) could not be parsed", len(problems))
+	}
+	return nil
+}
@@ -5,29 +5,37 @@ package main
 
 import (
 	"bytes"
-	"encoding/hex"
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"net"
-	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/szampardi/msg"
 	"github.com/szampardi/xprint/temple"
 )
 
+// templateData is the dot of the executed template
+type templateData struct {
+	Args  []string
+	Stdin string
+	Data  map[string]interface{}
+	Input interface{}
+}
+
 var (
-	l    log.Logger //
-	data            = struct {
-		Args  []string
-		Stdin string
-	}{} //
+	l          log.Logger                                                                           //
+	data                  = templateData{}                                                          //
 	name                  = flag.String("n", path.Base(os.Args[0]), "set name for verbose logging") //
 	logfmt     log.Format = log.Formats[log.PlainFormat]                                            //
 	loglvl     log.Lvl    = log.LNotice                                                             //
@@ -36,16 +44,77 @@ var (
 		S      string
 		IsFile bool
 	}
+	_dataFiles []struct {
+		Name string
+		Path string
+	}
 	showFns               *bool    = flag.Bool("H", false, "print available template functions and exit")                              //
 	debug                 *bool    = flag.Bool("D", false, "debug init and template rendering activities")                             //
 	output                *os.File                                                                                                     //
 	isHTML                *bool    = flag.Bool("html", false, "use html/template instead of text/template")                            //
 	argsfirst             *bool    = flag.Bool("a", false, "output arguments (if any) before stdin (if any), instead of the opposite") //
 	showVersion           *bool    = flag.Bool("v", false, "print build version/date and exit")                                        //
-	server                *string  = flag.String("s", "", "start a render server on given address")                                    //
+	server                *string  = flag.String("s", "", "start a render server on given address (tcp://, https:// or unix://)")      //
 	semver, commit, built          = "v0.0.0-dev", "local", "a while ago"                                                              //
 )
 
+// subcommands replace the default rendering, their flags are the usual ones and follow the subcommand name
+var subcommands = map[string]func(context.Context) error{
+	"check":      check,
+	"inspect":    inspect,
+	"render-dir": renderDir,
+	"test":       runTests,
+}
+
+// dataName is the name in -d name=path, anything else before a = is part of the path
+var dataName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var (
+	subcommand  string
+	allowUnsafe bool
+	policy      = &temple.Policy{}
+	engine      *temple.Engine
+	fileRoot    = flag.String("root", "", "jail file-touching template functions to this directory")
+	readOnly    = flag.Bool("ro", false, "deny template functions writing files")
+	inputFormat = flag.String("i", os.Getenv("XPRINT_INPUT"), "parse stdin into .Input, one of: auto, json, yaml, ndjson, csv (XPRINT_INPUT)")
+	watch       = flag.Bool("w", false, "watch templates, data files and files read while rendering, render again when they change")
+	debounce    = flag.Duration("debounce", 500*time.Millisecond, "with -w, wait for changes to settle this long before rendering again")
+	execCmd     = flag.String("x", "", "command to run (with sh -c) after rendering, when the output changed")
+	execTimeout = flag.Duration("xt", 30*time.Second, "timeout for the -x command")
+	outputPath  string
+	writeOpts   temple.WriteOptions
+	timeout     = flag.Duration("timeout", 0, "stop rendering a template after this long")
+	maxOutput   = flag.Int64("maxout", 0, "maximum size in bytes of a rendered template")
+	callLimits  = map[string]int{}
+	jsonOutput  = flag.Bool("json", false, "check, inspect: print results as json")
+	tplSuffix   = flag.String("suffix", ".tmpl", "render-dir: files with this suffix are templates, it's stripped from the rendered file name")
+	pluginPath  = flag.String("plugins", os.Getenv("XPRINT_PLUGIN_PATH"), "directories (separated like PATH) with xprint-fn-* executables providing more template functions (XPRINT_PLUGIN_PATH)")
+	functions   = temple.FnMap
+	record      = flag.String("record", "", "record the results of side-effecting functions (http, cmd, env, timestamp, random, userinput and plugins) to this cassette file")
+	replay      = flag.String("replay", "", "serve the results of side-effecting functions from this cassette file, failing on calls it doesn't have")
+	cassette    *temple.Cassette
+	secretEnv   []string
+	traceFile   = flag.String("trace", "", "write every template function call, with its duration and position, to this file, and a summary of the slowest ones to stderr")
+	traceFormat = flag.String("tracefmt", temple.TraceNDJSON, "-trace file format, one of: ndjson, chrome (trace event format, for chrome://tracing or Perfetto)")
+	tracer      *temple.TraceWriter
+	metrics     *temple.Metrics
+	authFile    = flag.String("auth", "", "render server: require the bearer tokens or client certificates in this file (json, yaml or toml), reloaded on SIGHUP")
+	certFile    = flag.String("cert", "", "render server: TLS certificate (chain) PEM file for https:// addresses, reloaded when it changes")
+	keyFile     = flag.String("key", "", "render server: TLS private key PEM file for -cert")
+	selfSigned  = flag.Bool("selfsigned", false, "render server: serve https:// with a generated self-signed certificate, for local use")
+	maxBody     = flag.Int64("maxbody", 10<<20, "render server: maximum size in bytes of a request body, larger ones get 413 (0 for no limit)")
+	maxTpls     = flag.Int("maxtemplates", 100, "render server: maximum number of templates in a render request, and in the -templates store (0 for no limit)")
+	maxTplSize  = flag.Int64("maxtplsize", 1<<20, "render server: maximum size in bytes of a posted or stored template (0 for no limit)")
+	clientReqs  = flag.Int("maxclientreqs", 8, "render server: requests of a client, by identity or address, handled at the same time, more get 429 (0 for no limit)")
+	hdrTimeout  = flag.Duration("headertimeout", 10*time.Second, "render server: timeout for reading request headers")
+	readTimeout = flag.Duration("readtimeout", time.Minute, "render server: timeout for reading a whole request")
+	wrTimeout   = flag.Duration("writetimeout", 5*time.Minute, "render server: timeout for handling a request and writing the response, from the end of its headers")
+	idleTimeout = flag.Duration("idletimeout", 2*time.Minute, "render server: how long idle keep-alive connections are kept")
+	storeDir    = flag.String("templates", "", "render server: serve the templates in this directory by name (POST /render/NAME), changes made with PUT and DELETE /templates/NAME are written to it")
+	update      = flag.Bool("update", false, "test: write the rendered output to the golden files instead of comparing it")
+	helpFormat  = flag.String("hf", "", "-H output format, one of: table, detail, markdown, man, json (default table, detail when arguments are function names)")
+)
+
 func unsafeMode() bool {
 	envvar, err := strconv.ParseBool(os.Getenv("XPRINT_UNSAFE"))
 	if err != nil {
@@ -66,7 +135,46 @@ func logFmts() []string {
 }
 
 func setFlags() {
-	flag.BoolVar(&temple.EnableUnsafeFunctions, "u", unsafeMode(), fmt.Sprintf("allow evaluation of dangerous template functions (%v)", temple.FnMap.UnsafeFuncs()))
+	flag.BoolVar(&allowUnsafe, "u", unsafeMode(), fmt.Sprintf("allow evaluation of dangerous template functions (%v)", temple.FnMap.UnsafeFuncs()))
+	flag.Func(
+		"p",
+		"function policy file (json, yaml or toml): allow/deny single functions and constrain their arguments",
+		func(value string) error {
+			p, err := temple.LoadPolicy(value)
+			if err != nil {
+				return err
+			}
+			policy = p
+			return nil
+		},
+	)
+	flag.Func(
+		"calls",
+		"limit calls to a function during a render, as name=max. this flag can be specified more than once.",
+		func(value string) error {
+			i := strings.Index(value, "=")
+			if i < 1 {
+				return fmt.Errorf("invalid call limit [%s] specified, use name=max", value)
+			}
+			max, err := strconv.Atoi(value[i+1:])
+			if err != nil {
+				return err
+			}
+			callLimits[value[:i]] = max
+			return nil
+		},
+	)
+	flag.Func(
+		"secretenv",
+		"record the values of the environment variables matching this pattern as [REDACTED] in the -record cassette. this flag can be specified more than once.",
+		func(value string) error {
+			if _, err := path.Match(value, ""); err != nil {
+				return err
+			}
+			secretEnv = append(secretEnv, value)
+			return nil
+		},
+	)
 	flag.Func(
 		"F",
 		fmt.Sprintf("logging format (prefix) %v", logFmts()),
@@ -122,39 +230,118 @@ the others can be accessed with the "template" Action.
 			return nil
 		},
 	)
+	flag.Func(
+		"d",
+		`data file(s) (json, yaml, toml or .env) to load into .Data, as name=path (name being an identifier) or just path.
+this flag can be specified more than once, later files are deep-merged over earlier ones.
+`,
+		func(value string) error {
+			var name string
+			if i := strings.Index(value, "="); i > 0 && dataName.MatchString(value[:i]) {
+				name, value = value[:i], value[i+1:]
+			}
+			_, err := os.Stat(value)
+			if err != nil {
+				return err
+			}
+			_dataFiles = append(_dataFiles, struct {
+				Name string
+				Path string
+			}{name, value})
+			return nil
+		},
+	)
 	flag.Func(
 		"o",
 		"output to (default is stdout for rendered templates/logs, stderr for everything else)",
 		func(value string) error {
 			switch value {
 			case "", "1", "stdout", "/dev/stdout", os.Stdout.Name():
-				output = os.Stdout
+				output, outputPath = os.Stdout, ""
 				return nil
 			case "2", "stderr", "/dev/stderr", os.Stderr.Name():
-				output = os.Stderr
+				output, outputPath = os.Stderr, ""
 				return nil
 			}
-			var err error
-			output, err = os.OpenFile(value, os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.FileMode(0600))
-			return err
+			output, outputPath = nil, value
+			return nil
+		},
+	)
+	flag.BoolVar(&writeOpts.Mkdir, "mkdir", false, "create missing parent directories of the -o file")
+	flag.Func(
+		"om",
+		fmt.Sprintf("how to write the -o file: %s (default), %s or %s (write a temporary file and rename it)", temple.WriteAppend, temple.WriteTruncate, temple.WriteAtomic),
+		func(value string) error {
+			switch value {
+			case temple.WriteAppend, temple.WriteTruncate, temple.WriteAtomic:
+				writeOpts.Mode = value
+				return nil
+			}
+			return fmt.Errorf("invalid output mode [%s] specified", value)
+		},
+	)
+	flag.Func(
+		"perm",
+		"file mode of the -o file (octal, default is the existing file's or 0600)",
+		func(value string) error {
+			perm, err := strconv.ParseUint(value, 8, 32)
+			if err != nil {
+				return err
+			}
+			writeOpts.Perm = os.FileMode(perm)
+			return nil
 		},
 	)
 }
 
-func init() {
+// setup parses the command line and prepares what main needs: the logger, the output, the data and the engine
+func setup() {
 	var err error
 	setFlags()
+	if len(os.Args) > 1 {
+		if _, ok := subcommands[os.Args[1]]; ok {
+			subcommand = os.Args[1]
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
 	for !flag.Parsed() {
 		flag.Parse()
 	}
+	if allowUnsafe {
+		policy.Unsafe = true
+	}
+	if *fileRoot != "" {
+		policy.Root = *fileRoot
+	}
+	if *readOnly {
+		policy.ReadOnly = true
+	}
+	if *timeout > 0 {
+		policy.Limits.Timeout = temple.Duration(*timeout)
+	}
+	if *maxOutput > 0 {
+		policy.Limits.MaxOutput = *maxOutput
+	}
+	for fname, max := range callLimits {
+		if policy.Limits.Calls == nil {
+			policy.Limits.Calls = map[string]int{}
+		}
+		policy.Limits.Calls[fname] = max
+	}
 	if *showVersion {
 		fmt.Fprintf(os.Stderr, "github.com/szampardi/xprint version %s (%s) built %s\n", semver, commit, built)
 		os.Exit(0)
 	}
+	if *pluginPath != "" {
+		if err = loadPlugins(filepath.SplitList(*pluginPath)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
 	if *showFns {
-		_, err = os.Stderr.WriteString(temple.FnMap.HelpText())
-		if err != nil {
-			panic(err)
+		if err = showFunctions(flag.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
 		os.Exit(0)
 	}
@@ -165,6 +352,9 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+	if err = openOutput(); err != nil {
+		panic(err)
+	}
 	if output != nil {
 		l.SetOutput(output)
 	}
@@ -174,113 +364,255 @@ func init() {
 			l.Errorf("reading %s: %s", stdin.Name(), err)
 		} else {
 			data.Stdin = string(b)
+			if *inputFormat != "" {
+				data.Input, err = temple.ParseInput(b, *inputFormat)
+				if err != nil {
+					l.Errorf("parsing %s: %s", stdin.Name(), err)
+					os.Exit(1)
+				}
+			}
 		}
 	}
 	data.Args = flag.Args()
+	data.Data, err = loadData()
+	if err != nil {
+		panic(err)
+	}
+	opts := []temple.Option{temple.WithFunctions(functions), temple.WithPolicy(policy), temple.WithHTML(*isHTML)}
+	if cassette, err = openCassette(); err != nil {
+		l.Errorf("%s", err)
+		os.Exit(1)
+	} else if cassette != nil {
+		opts = append(opts, temple.WithCassette(cassette))
+	}
+	if *watch {
+		opts = append(opts, temple.WithTracer(trackFilesRead))
+	}
+	if *traceFile != "" {
+		if tracer, err = openTrace(); err != nil {
+			l.Errorf("%s", err)
+			os.Exit(1)
+		}
+		opts = append(opts, temple.WithTracer(tracer.Trace))
+	}
+	if *server != "" {
+		metrics = temple.NewMetrics()
+		opts = append(opts, temple.WithTracer(metrics.Trace))
+	}
+	engine = temple.NewEngine(opts...)
+}
+
+// openCassette opens the -record or -replay cassette, plugin functions are recorded too
+func openCassette() (*temple.Cassette, error) {
+	var c *temple.Cassette
+	var err error
+	switch {
+	case *record != "" && *replay != "":
+		return nil, fmt.Errorf("-record and -replay can't be used together")
+	case *record != "":
+		c, err = temple.OpenCassette(*record, temple.CassetteRecord)
+	case *replay != "":
+		c, err = temple.OpenCassette(*replay, temple.CassetteReplay)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.Functions = append([]string{}, temple.CassetteFunctions...)
+	c.SecretEnv = secretEnv
+	for name := range functions {
+		if _, ok := temple.FnMap[name]; !ok {
+			c.Functions = append(c.Functions, name)
+		}
+	}
+	return c, nil
+}
+
+// openTrace creates the -trace file
+func openTrace() (*temple.TraceWriter, error) {
+	f, err := os.Create(*traceFile)
+	if err != nil {
+		return nil, err
+	}
+	return temple.NewTraceWriter(f, *traceFormat)
+}
+
+// closeTrace ends the -trace file and prints the summary of the calls
+func closeTrace() {
+	if tracer == nil {
+		return
+	}
+	if err := tracer.Close(); err != nil {
+		l.Errorf("writing %s: %s", *traceFile, err)
+	}
+	tracer.WriteSummary(os.Stderr)
+}
+
+// loadPlugins adds the functions of the plugins in dirs to the built-in ones
+func loadPlugins(dirs []string) error {
+	plugins, err := temple.LoadPlugins(dirs...)
+	if err != nil {
+		return err
+	}
+	functions = temple.FnMap.Clone()
+	for name, f := range plugins {
+		if err = functions.Register(name, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openOutput opens the -o file for appending, in the other write modes it's written as a whole by emit
+func openOutput() error {
+	if outputPath == "" {
+		return nil
+	}
+	if writeOpts.Mkdir {
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+			return err
+		}
+	}
+	if writeOpts.Mode != "" && writeOpts.Mode != temple.WriteAppend {
+		return nil
+	}
+	perm := writeOpts.Perm
+	if perm == 0 {
+		perm = 0600
+	}
+	var err error
+	if output, err = os.OpenFile(outputPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, perm); err == nil && writeOpts.Perm != 0 {
+		err = output.Chmod(perm) // the file may exist already, with another mode
+	}
+	return err
+}
+
+func loadData() (map[string]interface{}, error) {
+	out := make(map[string]interface{})
+	for _, df := range _dataFiles {
+		m, err := temple.LoadDataFile(df.Path)
+		if err != nil {
+			return nil, err
+		}
+		if df.Name == "" {
+			out = temple.MergeData(out, m)
+			continue
+		}
+		prev, _ := out[df.Name].(map[string]interface{})
+		out[df.Name] = temple.MergeData(prev, m)
+	}
+	return out, nil
 }
 
 func main() {
+	setup()
 	if *debug {
 		temple.DebugHTTPRequests = true
 	}
 	temple.StartTracking()
 	if *server != "" {
-		if output == nil {
-			output = os.Stderr
-		}
-		var err error
-		l, err = log.New(log.Formats[log.StdFormat].String(), log.Formats[log.DefTimeFmt].String(), loglvl, *logcolor, *name, output)
-		if err != nil {
-			panic(err)
-		}
-		u, err := url.Parse(*server)
+		serve()
+	}
+	// interrupting cancels running functions (http requests, commands) instead of killing xprint right away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if subcommand != "" {
+		err := subcommands[subcommand](ctx)
+		closeTrace()
 		if err != nil {
-			panic(err)
-		}
-		proto := strings.Split(u.Scheme, ":")[0]
-		var addr string
-		if proto != "unix" {
-			addr = net.JoinHostPort(u.Hostname(), u.Port())
-		} else {
-			addr = u.Hostname()
+			l.Errorf("%s: %s", subcommand, err)
+			os.Exit(exitCode(ctx, 1))
 		}
-		lis, err := net.Listen(proto, addr)
-		if err != nil {
-			panic(err)
+		return
+	}
+	buf, err := render(ctx)
+	if err != nil {
+		closeTrace()
+		if ctx.Err() != nil {
+			l.Errorf("interrupted: %s", err)
+			os.Exit(exitCode(ctx, 1))
 		}
-		l.Noticef("set up %s listener on %s", proto, lis.Addr().String())
-		http.HandleFunc("/render", temple.RenderServer(temple.FnMap))
-		http.HandleFunc("/", temple.UIPage())
-		panic(http.Serve(lis, nil).Error())
+		panic(err)
+	}
+	seedLastRender()
+	if *watch {
+		afterRender(ctx, emit(buf))
+		watchRender(ctx)
+		closeTrace()
+		os.Exit(exitCode(ctx, 0))
 	}
+	if buf.Len() < 1 {
+		closeTrace()
+		os.Exit(0)
+	}
+	written := emit(buf)
+	closeTrace()
+	if code := afterRender(ctx, written); code != 0 {
+		os.Exit(code)
+	}
+}
+
+// exitCode is what to exit with after ctx may have been canceled by a signal
+func exitCode(ctx context.Context, code int) int {
+	if ctx.Err() != nil {
+		return 130
+	}
+	return code
+}
+
+// render executes the templates, or concatenates stdin and arguments if there are none
+func render(ctx context.Context) (*bytes.Buffer, error) {
 	buf := new(bytes.Buffer)
-	if len(_templates) > 0 {
-		argTemplates := map[string]string{}
-		localTemplates := []string{}
-		for n, t := range _templates {
-			if !t.IsFile {
-				if len(t.S) > 0 {
-					argTemplates[fmt.Sprintf("opt%d", n)] = t.S
-				}
-			} else {
-				localTemplates = append(localTemplates, t.S)
-			}
+	if len(_templates) < 1 {
+		if !*argsfirst {
+			buf.WriteString(data.Stdin)
 		}
-		var err error
-		switch *isHTML {
-		case true:
-			tpl, tplList, err := temple.FnMap.BuildHTMLTemplate(temple.EnableUnsafeFunctions, hex.EncodeToString(temple.Random(12)), "", argTemplates, localTemplates...)
-			if err != nil {
-				panic(err)
-			}
-			if len(tplList) > 1 {
-				err = tpl.Execute(buf, data)
-			} else {
-				err = tpl.ExecuteTemplate(buf, tplList[0], data)
-			}
-		case false:
-			tpl, tplList, err := temple.FnMap.BuildTemplate(temple.EnableUnsafeFunctions, hex.EncodeToString(temple.Random(12)), "", argTemplates, localTemplates...)
-			if err != nil {
-				panic(err)
-			}
-			if len(tplList) > 1 {
-				err = tpl.Execute(buf, data)
-			} else {
-				err = tpl.ExecuteTemplate(buf, tplList[0], data)
-			}
+		for _, s := range data.Args {
+			buf.WriteString(s)
 		}
-		if err != nil {
-			panic(err)
+		if *argsfirst {
+			buf.WriteString(data.Stdin)
 		}
-		if *debug {
-			temple.Tracking.Wait()
+		return buf, nil
+	}
+	templates, err := commandlineTemplates(nil)
+	if err != nil {
+		return nil, err
+	}
+	resetFilesRead()
+	pt, err := engine.Parse(templates...)
+	if err == nil {
+		// the last template given is executed, the others can be called from it
+		pt, _ = pt.Lookup(templates[len(templates)-1].Name)
+		err = pt.Execute(ctx, data, buf)
+	}
+	if cassette != nil {
+		if serr := cassette.Save(); serr != nil {
+			l.Errorf("saving %s: %s", *record, serr)
+		}
+		for _, call := range cassette.Unused() {
+			l.Warningf("%s: call not replayed: %s", *replay, call)
 		}
-	} else {
-		func() {
-			if !*argsfirst {
-				_, err := fmt.Fprintf(buf, "%s", data.Stdin)
-				if err != nil {
-					panic(err)
-				}
-			} else {
-				defer func() {
-					_, err := fmt.Fprintf(buf, "%s", data.Stdin)
-					if err != nil {
-						panic(err)
-					}
-				}()
-			}
-			for _, s := range data.Args {
-				_, err := fmt.Fprintf(buf, "%s", s)
-				if err != nil {
-					panic(err)
-				}
-			}
-		}()
 	}
-	if buf.Len() < 1 {
-		os.Exit(0)
+	if err != nil {
+		return nil, err
+	}
+	if *debug {
+		temple.Tracking.Wait()
+	}
+	return buf, nil
+}
+
+// emit logs buf at the configured level, which with the default format is just printing it, and returns what was written
+func emit(buf *bytes.Buffer) []byte {
+	var w io.Writer = os.Stdout
+	if output != nil {
+		w = output
 	}
+	logged := new(bytes.Buffer)
+	l.SetOutput(logged)
+	defer l.SetOutput(os.Stderr) // what's logged after the render isn't part of the output
 	switch loglvl {
 	case log.LCrit:
 		l.Criticalf("%s", buf.String())
@@ -295,4 +627,14 @@ func main() {
 	case log.LDebug:
 		l.Debugf("%s", buf.String())
 	}
+	var err error
+	if output == nil && outputPath != "" {
+		err = temple.WriteFile(outputPath, bytes.NewReader(logged.Bytes()), writeOpts)
+	} else {
+		_, err = w.Write(logged.Bytes())
+	}
+	if err != nil {
+		panic(err)
+	}
+	return logged.Bytes()
 }
@@ -0,0 +1,94 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/szampardi/xprint/temple"
+)
+
+func TestRenderRunsLastTemplate(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"lib.tmpl": `{{define "x"}}X{{end}}LIB`, "main.tmpl": `MAIN {{template "x"}}`}
+	for name, text := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lib, main := filepath.Join(dir, "lib.tmpl"), filepath.Join(dir, "main.tmpl")
+	engine = temple.NewEngine()
+	defer func() { engine, _templates = nil, nil }()
+	type tpl = struct {
+		S      string
+		IsFile bool
+	}
+	cases := []struct {
+		name      string
+		templates []tpl
+		want      string
+	}{
+		{"files", []tpl{{lib, true}, {main, true}}, "MAIN X"},
+		{"files reversed", []tpl{{main, true}, {lib, true}}, "LIB"},
+		{"file then text", []tpl{{lib, true}, {`TEXT {{template "x"}}`, false}}, "TEXT X"},
+		{"text then file", []tpl{{`{{define "x"}}Y{{end}}`, false}, {main, true}}, "MAIN Y"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_templates = c.templates
+			buf, err := render(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(buf.String()); got != c.want {
+				t.Fatalf("expected %q, got %q", c.want, got)
+			}
+		})
+	}
+}
+
+func TestOpenOutputPerm(t *testing.T) {
+	defer func(path string, opts temple.WriteOptions) {
+		outputPath, writeOpts, output = path, opts, nil
+	}(outputPath, writeOpts)
+	dir := t.TempDir()
+	cases := []struct {
+		name     string
+		existing bool
+		perm     os.FileMode
+		want     os.FileMode
+	}{
+		{"new", false, 0, 0600},
+		{"new with perm", false, 0640, 0640},
+		{"existing", true, 0, 0604},
+		{"existing with perm", true, 0640, 0640},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			outputPath = filepath.Join(dir, strings.ReplaceAll(c.name, " ", "-"))
+			writeOpts = temple.WriteOptions{Mode: temple.WriteAppend, Perm: c.perm}
+			if c.existing {
+				if err := ioutil.WriteFile(outputPath, nil, 0604); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := openOutput(); err != nil {
+				t.Fatal(err)
+			}
+			defer output.Close()
+			info, err := os.Stat(outputPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != c.want {
+				t.Fatalf("expected %s, got %s", c.want, info.Mode().Perm())
+			}
+		})
+	}
+}
@@ -0,0 +1,19 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// xprint [flags] render-dir SRC DST
+func renderDir(ctx context.Context) error {
+	if len(data.Args) != 2 {
+		return fmt.Errorf("usage: %s render-dir [flags] SRC DST", *name)
+	}
+	src, dst := data.Args[0], data.Args[1]
+	data.Args = nil
+	return engine.RenderDir(ctx, src, dst, *tplSuffix, data)
+}
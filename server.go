@@ -0,0 +1,169 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/szampardi/msg"
+	"github.com/szampardi/xprint/temple"
+)
+
+// serve runs the render server on the -s address
+func serve() {
+	if output == nil {
+		output = os.Stderr
+	}
+	var err error
+	l, err = log.New(log.Formats[log.StdFormat].String(), log.Formats[log.DefTimeFmt].String(), loglvl, *logcolor, *name, output)
+	if err != nil {
+		panic(err)
+	}
+	u, err := url.Parse(*server)
+	if err != nil {
+		panic(err)
+	}
+	proto := strings.Split(u.Scheme, ":")[0]
+	secure := proto == "https"
+	if secure {
+		proto = "tcp"
+	}
+	var addr string
+	if proto != "unix" {
+		addr = net.JoinHostPort(u.Hostname(), u.Port())
+	} else {
+		addr = u.Hostname()
+	}
+	var auth *temple.Auth
+	if *authFile != "" {
+		if auth, err = temple.LoadAuth(*authFile); err != nil {
+			panic(err)
+		}
+		go reloadOnHangup(auth)
+	} else {
+		l.Warningf("no -auth file given, anyone who can reach the server can use it")
+	}
+	lis, err := net.Listen(proto, addr)
+	if err != nil {
+		panic(err)
+	}
+	var certs *temple.CertificateSource
+	if secure {
+		if certs, err = serverCertificate(u.Hostname()); err != nil {
+			panic(err)
+		}
+		tlsConfig := certs.TLSConfig()
+		auth.ConfigureTLS(tlsConfig)
+		lis = tls.NewListener(lis, tlsConfig)
+	} else if *certFile != "" || *selfSigned {
+		l.Warningf("-cert and -selfsigned are only used with https:// addresses")
+	}
+	l.Noticef("set up %s listener on %s", u.Scheme, lis.Addr().String())
+	store, err := temple.NewTemplateStore(engine, *storeDir)
+	if err != nil {
+		panic(err)
+	}
+	l.Noticef("serving %d stored template(s)", len(store.Names()))
+	limits := &temple.ServerLimits{MaxBody: *maxBody, MaxTemplates: *maxTpls, MaxTemplateSize: *maxTplSize, MaxPerClient: *clientReqs}
+	handle := func(pattern, handler, scope string, h http.HandlerFunc) {
+		http.HandleFunc(pattern, metrics.Instrument(handler, auth.Require(scope, limits.Limit(h))))
+	}
+	handle("/render", "render", temple.ScopeRender, temple.RenderServer(engine))
+	handle("/render/", "render_stored", temple.ScopeRender, temple.StoredRenderServer(engine, store))
+	handle("/templates", "templates", temple.ScopeTemplates, temple.TemplatesServer(engine, store))
+	handle("/templates/", "templates", temple.ScopeTemplates, temple.TemplatesServer(engine, store))
+	handle("/", "ui", temple.ScopeRender, temple.UIPage())
+	http.HandleFunc("/metrics", auth.Require(temple.ScopeMetrics, temple.MetricsServer(metrics)))
+	http.HandleFunc("/healthz", temple.HealthServer())
+	http.HandleFunc("/readyz", temple.ReadyServer(metrics, readyChecks(certs)))
+	srv := &http.Server{
+		ReadHeaderTimeout: *hdrTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *wrTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+	metrics.SetReady(true)
+	panic(srv.Serve(lis).Error())
+}
+
+// serverCertificate is the certificate of the https server: the -cert one, reloaded when it changes, or a self-signed one
+func serverCertificate(host string) (*temple.CertificateSource, error) {
+	var certs *temple.CertificateSource
+	var err error
+	switch {
+	case *certFile != "" && *selfSigned:
+		return nil, fmt.Errorf("-cert and -selfsigned are mutually exclusive")
+	case *certFile != "":
+		if *keyFile == "" {
+			return nil, fmt.Errorf("-cert needs -key")
+		}
+		if certs, err = temple.LoadCertificate(*certFile, *keyFile); err != nil {
+			return nil, err
+		}
+		go certs.Watch(context.Background(), time.Second, func(err error) {
+			if err != nil {
+				l.Errorf("reloading %s, keeping the previous certificate: %s", *certFile, err)
+				return
+			}
+			l.Noticef("reloaded %s, valid until %s", *certFile, certs.Leaf().NotAfter.Format(time.RFC3339))
+		})
+	case *selfSigned:
+		hosts := []string{"localhost", "127.0.0.1", "::1"}
+		if host != "" && host != "localhost" && net.ParseIP(host) == nil {
+			hosts = append([]string{host}, hosts...)
+		} else if ip := net.ParseIP(host); ip != nil && !ip.IsLoopback() && !ip.IsUnspecified() {
+			hosts = append(hosts, host)
+		}
+		if certs, err = temple.SelfSignedCertificate(hosts...); err != nil {
+			return nil, err
+		}
+		l.Warningf("serving with a self-signed certificate for %s, clients won't trust it", strings.Join(hosts, ", "))
+	default:
+		return nil, fmt.Errorf("https needs -cert and -key, or -selfsigned")
+	}
+	return certs, nil
+}
+
+// readyChecks are what /readyz checks besides the server being up: the certificate being valid and the store directory readable
+func readyChecks(certs *temple.CertificateSource) map[string]func() error {
+	checks := map[string]func() error{}
+	if certs != nil {
+		checks["certificate"] = func() error {
+			if leaf := certs.Leaf(); leaf != nil && time.Now().After(leaf.NotAfter) {
+				return fmt.Errorf("expired on %s", leaf.NotAfter.Format(time.RFC3339))
+			}
+			return nil
+		}
+	}
+	if *storeDir != "" {
+		checks["templates"] = func() error {
+			_, err := os.Stat(*storeDir)
+			return err
+		}
+	}
+	return checks
+}
+
+// reloadOnHangup reads the -auth file again on SIGHUP
+func reloadOnHangup(auth *temple.Auth) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := auth.Reload(); err != nil {
+			l.Errorf("reloading %s, keeping the previous one: %s", *authFile, err)
+			continue
+		}
+		l.Noticef("reloaded %s", *authFile)
+	}
+}
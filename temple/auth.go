@@ -0,0 +1,201 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/szampardi/msg"
+	"gopkg.in/yaml.v3"
+)
+
+// what a token or client certificate allows
+const (
+	ScopeRender    = "render"    // render templates, posted or stored
+	ScopeTemplates = "templates" // list, read, store and delete stored templates
+	ScopeUnsafe    = "unsafe"    // renders can use the unsafe functions the policy allows
+	ScopeMetrics   = "metrics"   // scrape /metrics
+)
+
+type (
+	// AuthConfig lists who can use the render server, it's read from a JSON, YAML or TOML file
+	AuthConfig struct {
+		Tokens   []AuthToken  `json:"tokens" yaml:"tokens" toml:"tokens"`
+		Clients  []AuthClient `json:"clients" yaml:"clients" toml:"clients"`
+		ClientCA string       `json:"client_ca" yaml:"client_ca" toml:"client_ca"` // PEM file with the CAs client certificates are verified with
+	}
+	// AuthToken is a bearer token, sent as "Authorization: Bearer TOKEN"
+	AuthToken struct {
+		Name   string   `json:"name" yaml:"name" toml:"name"` // for the logs
+		Token  string   `json:"token" yaml:"token" toml:"token"`
+		Scopes []string `json:"scopes" yaml:"scopes" toml:"scopes"`
+	}
+	// AuthClient is a TLS client, by the common name of its verified certificate
+	AuthClient struct {
+		Name   string   `json:"name" yaml:"name" toml:"name"`
+		Scopes []string `json:"scopes" yaml:"scopes" toml:"scopes"`
+	}
+	// Auth authenticates the requests to the render server, with the configuration in a file that can be reloaded
+	Auth struct {
+		path      string
+		cfg       *AuthConfig
+		clientCAs *x509.CertPool
+		mu        sync.RWMutex
+	}
+	// Identity is who made a request, and what they can do
+	Identity struct {
+		Name   string
+		Scopes []string
+	}
+	identityKey struct{}
+)
+
+// LoadAuth reads the auth configuration in path
+func LoadAuth(path string) (*Auth, error) {
+	a := &Auth{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads the configuration file again, on errors the old configuration stays in use
+func (a *Auth) Reload() error {
+	b, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	cfg := &AuthConfig{}
+	switch DetectDataFormat(a.path, b) {
+	case FormatJSON:
+		err = json.Unmarshal(b, cfg)
+	case FormatTOML:
+		err = toml.Unmarshal(b, cfg)
+	default:
+		err = yaml.Unmarshal(b, cfg)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", a.path, err)
+	}
+	for _, t := range cfg.Tokens {
+		if t.Token == "" {
+			return fmt.Errorf("%s: token %s is empty", a.path, t.Name)
+		}
+	}
+	var pool *x509.CertPool
+	if cfg.ClientCA != "" {
+		pem, err := ioutil.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificates found", cfg.ClientCA)
+		}
+	}
+	a.mu.Lock()
+	a.cfg, a.clientCAs = cfg, pool
+	a.mu.Unlock()
+	return nil
+}
+
+// ConfigureTLS makes c ask clients for a certificate, verified with the client CAs of the configuration
+// as they are when the client connects. Call it when c is otherwise complete.
+func (a *Auth) ConfigureTLS(c *tls.Config) {
+	if a == nil {
+		return
+	}
+	base := c.Clone()
+	c.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+		cc := base.Clone()
+		if a.clientCAs != nil {
+			cc.ClientAuth, cc.ClientCAs = tls.VerifyClientCertIfGiven, a.clientCAs
+		}
+		return cc, nil
+	}
+}
+
+// Authenticate tells who made r, by its bearer token or its verified client certificate
+func (a *Auth) Authenticate(r *http.Request) (*Identity, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if h := r.Header.Get("Authorization"); h != "" {
+		if !strings.HasPrefix(h, "Bearer ") {
+			return nil, false
+		}
+		token := []byte(strings.TrimSpace(strings.TrimPrefix(h, "Bearer ")))
+		var found *AuthToken
+		for i, t := range a.cfg.Tokens {
+			if subtle.ConstantTimeCompare(token, []byte(t.Token)) == 1 {
+				found = &a.cfg.Tokens[i]
+			}
+		}
+		if found == nil {
+			return nil, false
+		}
+		return &Identity{"token " + found.Name, found.Scopes}, true
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for _, c := range a.cfg.Clients {
+			if c.Name == cn {
+				return &Identity{"client " + c.Name, c.Scopes}, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Require lets through to next only the requests of who has scope. A nil Auth lets everything through.
+func (a *Auth) Require(scope string, next http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := a.Authenticate(r)
+		if !ok {
+			log.Warningf("rejected request ( %s %s ) from %s: not authenticated", r.Method, r.URL, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="xprint"`)
+			writeJSON(w, r, http.StatusUnauthorized, jresp{Status: http.StatusUnauthorized, Error: "authentication required"})
+			return
+		}
+		if !id.Can(scope) {
+			log.Warningf("rejected request ( %s %s ) from %s: %s lacks scope %s", r.Method, r.URL, r.RemoteAddr, id.Name, scope)
+			writeJSON(w, r, http.StatusForbidden, jresp{Status: http.StatusForbidden, Error: fmt.Sprintf("scope %s required", scope)})
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	}
+}
+
+// Can tells whether id has scope
+func (id *Identity) Can(scope string) bool {
+	return contains(id.Scopes, scope)
+}
+
+// RequestIdentity is who made r, if the server requires authentication
+func RequestIdentity(r *http.Request) (*Identity, bool) {
+	id, ok := r.Context().Value(identityKey{}).(*Identity)
+	return id, ok
+}
+
+// requestEngine is e, without unsafe functions if r was authenticated without the unsafe scope
+func requestEngine(e *Engine, r *http.Request) *Engine {
+	if id, ok := RequestIdentity(r); ok && !id.Can(ScopeUnsafe) {
+		return e.safe()
+	}
+	return e
+}
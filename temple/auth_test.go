@@ -0,0 +1,84 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.json")
+	cfg := `{
+		"tokens": [
+			{"name": "renderer", "token": "render-token", "scopes": ["render"]},
+			{"name": "admin", "token": "admin-token", "scopes": ["render", "templates", "unsafe"]}
+		],
+		"clients": [{"name": "ci", "scopes": ["render"]}]
+	}`
+	if err := ioutil.WriteFile(path, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := LoadAuth(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine(WithPolicy(&Policy{Unsafe: true}))
+	store, err := NewTemplateStore(e, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	render := auth.Require(ScopeRender, RenderServer(e))
+	templates := auth.Require(ScopeTemplates, TemplatesServer(e, store))
+	client := func(cn string) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+	}
+	const safe, unsafe = `{"template": "{{upper \"ok\"}}"}`, `{"template": "{{(cmd \"echo\" \"ran\").Stdout}}"}`
+	cases := []struct {
+		name          string
+		handler       http.HandlerFunc
+		authorization string
+		tls           *tls.ConnectionState
+		body          string
+		status        int
+		output        string
+	}{
+		{"no authorization", render, "", nil, safe, http.StatusUnauthorized, ""},
+		{"wrong token", render, "Bearer nope", nil, safe, http.StatusUnauthorized, ""},
+		{"not a bearer token", render, "Basic render-token", nil, safe, http.StatusUnauthorized, ""},
+		{"token", render, "Bearer render-token", nil, safe, http.StatusOK, "OK"},
+		{"missing scope", templates, "Bearer render-token", nil, "", http.StatusForbidden, ""},
+		{"scope", templates, "Bearer admin-token", nil, "", http.StatusOK, ""},
+		{"client certificate", render, "", client("ci"), safe, http.StatusOK, "OK"},
+		{"unknown client certificate", render, "", client("someone"), safe, http.StatusUnauthorized, ""},
+		{"unsafe without the scope", render, "Bearer render-token", nil, unsafe, http.StatusBadRequest, "not defined"},
+		{"unsafe client without the scope", render, "", client("ci"), unsafe, http.StatusBadRequest, "not defined"},
+		{"unsafe with the scope", render, "Bearer admin-token", nil, unsafe, http.StatusOK, "ran"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			method, target := http.MethodPost, "/render"
+			if c.body == "" {
+				method, target = http.MethodGet, "/templates"
+			}
+			r := httptest.NewRequest(method, target, strings.NewReader(c.body))
+			if c.authorization != "" {
+				r.Header.Set("Authorization", c.authorization)
+			}
+			r.TLS = c.tls
+			rec := httptest.NewRecorder()
+			c.handler(rec, r)
+			if rec.Code != c.status || !strings.Contains(rec.Body.String(), c.output) {
+				t.Fatalf("expected %d with %q, got %d %q", c.status, c.output, rec.Code, rec.Body)
+			}
+		})
+	}
+}
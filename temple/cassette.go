@@ -0,0 +1,295 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CassetteRecord = "record"
+	CassetteReplay = "replay"
+)
+
+// functions whose results depend on the world outside the template, recorded by default
+var CassetteFunctions = []string{"cmd", "env", "http", "random", "timestamp", "userinput"}
+
+type (
+	// Cassette records the calls to side-effecting functions, and their results, to replay them later
+	// so that renders are reproducible. In replay mode a call that wasn't recorded fails.
+	Cassette struct {
+		Mode      string
+		Functions []string // functions recorded or replayed, CassetteFunctions by default
+		SecretEnv []string // name patterns of the environment variables whose values are recorded as [REDACTED]
+		path      string
+		calls     []*fnTrack
+		used      []bool
+		mu        sync.Mutex
+	}
+	cassetteFile struct {
+		Calls []*fnTrack `json:"calls"`
+	}
+	// cassetteCodec stores results that don't survive a json round trip
+	cassetteCodec struct {
+		encode func(v reflect.Value) (interface{}, error)
+		decode func(b []byte) (reflect.Value, error)
+	}
+	recordedResponse struct {
+		Status     string      `json:"status"`
+		StatusCode int         `json:"statuscode"`
+		Header     http.Header `json:"header"`
+		Body       []byte      `json:"body"`
+	}
+	recordedCmd struct {
+		Stdout string `json:"stdout"`
+		Stderr string `json:"stderr"`
+	}
+)
+
+var cassetteCodecs = map[reflect.Type]cassetteCodec{
+	reflect.TypeOf(&http.Response{}): {
+		encode: func(v reflect.Value) (interface{}, error) {
+			resp := v.Interface().(*http.Response)
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			resp.Body = ioutil.NopCloser(bytes.NewReader(body)) // the template still reads it
+			return recordedResponse{resp.Status, resp.StatusCode, resp.Header, body}, err
+		},
+		decode: func(b []byte) (reflect.Value, error) {
+			var r recordedResponse
+			err := json.Unmarshal(b, &r)
+			return reflect.ValueOf(&http.Response{
+				Status:        r.Status,
+				StatusCode:    r.StatusCode,
+				Header:        r.Header,
+				Body:          ioutil.NopCloser(bytes.NewReader(r.Body)),
+				ContentLength: int64(len(r.Body)),
+			}), err
+		},
+	},
+	reflect.TypeOf(&cmdBuffers{}): {
+		encode: func(v reflect.Value) (interface{}, error) {
+			c := v.Interface().(*cmdBuffers)
+			return recordedCmd{c.stdout.String(), c.stderr.String()}, nil
+		},
+		decode: func(b []byte) (reflect.Value, error) {
+			var c recordedCmd
+			err := json.Unmarshal(b, &c)
+			return reflect.ValueOf(&cmdBuffers{bytes.NewBufferString(c.Stdout), bytes.NewBufferString(c.Stderr), &os.ProcessState{}}), err
+		},
+	},
+}
+
+// OpenCassette prepares a cassette stored at path, in replay mode the recorded calls are read from it
+func OpenCassette(path, mode string) (*Cassette, error) {
+	c := &Cassette{Mode: mode, Functions: CassetteFunctions, path: path}
+	switch mode {
+	case CassetteRecord:
+		return c, nil
+	case CassetteReplay:
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var f cassetteFile
+		if err = json.Unmarshal(b, &f); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		c.calls = f.Calls
+		c.used = make([]bool, len(f.Calls))
+		return c, nil
+	}
+	return nil, fmt.Errorf("unknown cassette mode %s, use %s or %s", mode, CassetteRecord, CassetteReplay)
+}
+
+// Save writes the recorded calls to the cassette file
+func (c *Cassette) Save() error {
+	if c.Mode != CassetteRecord {
+		return nil
+	}
+	c.mu.Lock()
+	b, err := json.MarshalIndent(cassetteFile{c.calls}, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return WriteFile(c.path, bytes.NewReader(append(b, '\n')), WriteOptions{WriteAtomic, 0, false})
+}
+
+// Unused lists the recorded calls a replay didn't make
+func (c *Cassette) Unused() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []string
+	for i, used := range c.used {
+		if !used {
+			out = append(out, callString(c.calls[i].F, c.calls[i].Args))
+		}
+	}
+	return out
+}
+
+// wrap records or replays the calls to f, if it's one of the cassette functions.
+// The sensitive arguments and results of info never reach the cassette: they're recorded as [REDACTED],
+// replays match the arguments redacted the same way and return [REDACTED] for the results.
+// The values of env are only sensitive for the variables in SecretEnv, replays need the others.
+func (c *Cassette) wrap(name string, info Function, f interface{}) interface{} {
+	if c == nil || !contains(c.Functions, name) {
+		return f
+	}
+	v := reflect.ValueOf(f)
+	t := v.Type()
+	return reflect.MakeFunc(t, func(args []reflect.Value) []reflect.Value {
+		callArgs := make([]interface{}, 0, len(args))
+		for i, a := range args {
+			if t.IsVariadic() && i == len(args)-1 {
+				for j := 0; j < a.Len(); j++ {
+					callArgs = append(callArgs, a.Index(j).Interface())
+				}
+				break
+			}
+			callArgs = append(callArgs, a.Interface())
+		}
+		info := c.redaction(name, info, callArgs)
+		if c.Mode == CassetteReplay {
+			callArgs, _ = info.redact(callArgs, nil)
+			return c.replay(name, t, callArgs)
+		}
+		out := callFn(v, args)
+		if err := c.record(name, info, t, callArgs, out); err != nil {
+			return errorResult(t, err)
+		}
+		return out
+	}).Interface()
+}
+
+// redaction is info, as far as the redaction of a call with args in the cassette is concerned
+func (c *Cassette) redaction(name string, info Function, args []interface{}) Function {
+	if name != "env" {
+		return info
+	}
+	info.Redact = nil
+	if len(args) > 0 {
+		for _, pattern := range c.SecretEnv {
+			if ok, _ := path.Match(pattern, fmt.Sprint(args[0])); ok {
+				info.Redact = &Redaction{Output: true}
+			}
+		}
+	}
+	return info
+}
+
+func (c *Cassette) record(name string, info Function, t reflect.Type, args []interface{}, out []reflect.Value) error {
+	var output interface{}
+	if len(out) > 0 && t.Out(0) != errorType {
+		output = out[0].Interface()
+	}
+	args, output = info.redact(args, output)
+	x := &fnTrack{T: time.Now(), F: name, Args: args}
+	if n := len(out); n > 1 || (n == 1 && t.Out(0) == errorType) {
+		if err, ok := out[n-1].Interface().(error); ok && err != nil {
+			x.Err = err.Error()
+		}
+	}
+	if _, sensitive := output.(Secret); sensitive {
+		x.Output = Redacted
+	} else if codec, ok := cassetteCodecs[t.Out(0)]; ok && !out[0].IsNil() {
+		var err error
+		if x.Output, err = codec.encode(out[0]); err != nil {
+			return fmt.Errorf("cassette: recording %s: %w", name, err)
+		}
+	} else {
+		x.Output = output
+	}
+	c.mu.Lock()
+	c.calls = append(c.calls, x)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Cassette) replay(name string, t reflect.Type, args []interface{}) []reflect.Value {
+	x, err := c.next(name, args)
+	if err != nil {
+		return errorResult(t, err)
+	}
+	out := make([]reflect.Value, t.NumOut())
+	for i := range out {
+		out[i] = reflect.Zero(t.Out(i))
+	}
+	if x.Err != "" && t.Out(t.NumOut()-1) == errorType {
+		err := errors.New(x.Err)
+		out[t.NumOut()-1] = reflect.ValueOf(&err).Elem()
+	}
+	if len(out) > 0 && t.Out(0) != errorType && x.Output != nil {
+		b, err := json.Marshal(x.Output)
+		if err != nil {
+			return errorResult(t, err)
+		}
+		if codec, ok := cassetteCodecs[t.Out(0)]; ok {
+			out[0], err = codec.decode(b)
+		} else {
+			p := reflect.New(t.Out(0))
+			err = json.Unmarshal(b, p.Interface())
+			out[0] = p.Elem()
+		}
+		if err != nil {
+			return errorResult(t, fmt.Errorf("cassette: replaying %s: %w", name, err))
+		}
+	}
+	return out
+}
+
+// next finds the first call to name with args the replay didn't use yet
+func (c *Cassette) next(name string, args []interface{}) (*fnTrack, error) {
+	want, err := canonicalJSON(append([]interface{}{}, args...))
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, x := range c.calls {
+		if c.used[i] || x.F != name {
+			continue
+		}
+		if got, err := canonicalJSON(append([]interface{}{}, x.Args...)); err == nil && got == want {
+			c.used[i] = true
+			return x, nil
+		}
+	}
+	return nil, fmt.Errorf("cassette: unexpected call %s", callString(name, args))
+}
+
+// canonicalJSON encodes v after a json round trip, so that values read from a cassette compare equal to the originals
+func canonicalJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	var generic interface{}
+	if err = json.Unmarshal(b, &generic); err != nil {
+		return "", err
+	}
+	b, err = json.Marshal(generic)
+	return string(b), err
+}
+
+func callString(name string, args []interface{}) string {
+	s := make([]string, 0, len(args))
+	for _, a := range args {
+		b, _ := json.Marshal(a)
+		s = append(s, string(b))
+	}
+	return fmt.Sprintf("%s(%s)", name, strings.Join(s, ", "))
+}
@@ -0,0 +1,78 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCassetteKeepsSecretsOut(t *testing.T) {
+	const token, envValue, plainValue = "Bearer t0k3n-never-recorded", "env-value-never-recorded", "plain-env-value"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	os.Setenv("XPRINT_TEST_SECRET", envValue)
+	os.Setenv("XPRINT_TEST_PLAIN", plainValue)
+	defer os.Unsetenv("XPRINT_TEST_SECRET")
+	defer os.Unsetenv("XPRINT_TEST_PLAIN")
+	text := `{{(http "POST" .URL (secret "body-never-recorded") .Headers).StatusCode}} {{env "XPRINT_TEST_SECRET"}} {{env "XPRINT_TEST_PLAIN"}}`
+	data := map[string]interface{}{"URL": srv.URL, "Headers": map[string]string{"Authorization": token}}
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	render := func(c *Cassette) string {
+		e := NewEngine(WithPolicy(&Policy{Unsafe: true}), WithCassette(c))
+		buf := new(bytes.Buffer)
+		if err := e.Render(context.Background(), []Template{{"secrets", text}}, data, buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	c, err := OpenCassette(path, CassetteRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SecretEnv = []string{"*_SECRET"}
+	if out := render(c); out != "200 "+envValue+" "+plainValue {
+		t.Fatalf("unexpected recorded render %q", out)
+	}
+	if err = c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"t0k3n", envValue, "body-never-recorded"} {
+		if strings.Contains(string(b), secret) {
+			t.Errorf("cassette contains %q:\n%s", secret, b)
+		}
+	}
+
+	if !strings.Contains(string(b), plainValue) {
+		t.Errorf("cassette lacks the value of XPRINT_TEST_PLAIN:\n%s", b)
+	}
+
+	os.Unsetenv("XPRINT_TEST_PLAIN")
+	if c, err = OpenCassette(path, CassetteReplay); err != nil {
+		t.Fatal(err)
+	}
+	if out := render(c); out != "200 "+Redacted+" "+plainValue {
+		t.Fatalf("unexpected replayed render %q", out)
+	}
+	if unused := c.Unused(); len(unused) > 0 {
+		t.Fatalf("calls not replayed: %v", unused)
+	}
+}
@@ -0,0 +1,207 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"text/template/parse"
+)
+
+const (
+	ProblemParse             = "parse-error"
+	ProblemUndefinedFunction = "undefined-function"
+	ProblemUnsafeFunction    = "unsafe-function"
+	ProblemDeniedFunction    = "denied-function"
+	ProblemUnusedDefine      = "unused-define"
+	ProblemUndefinedTemplate = "undefined-template"
+
+	SeverityError   = "error"
+	SeverityWarning = "warning" // reported, but not a reason to fail
+)
+
+type (
+	Problem struct {
+		Kind     string `json:"kind"`
+		Name     string `json:"name,omitempty"`
+		Position string `json:"position,omitempty"`
+		Message  string `json:"message"`
+		Severity string `json:"severity"`
+	}
+	parsedTemplates struct {
+		trees map[string]*parse.Tree
+		roots []string // top level templates, the ones that can be executed directly
+	}
+)
+
+var undefinedFunction = regexp.MustCompile(`function "([^"]+)" not defined`)
+
+// functions text/template always provides
+var builtinFuncs = map[string]bool{
+	"and": true, "call": true, "html": true, "index": true, "slice": true, "js": true, "len": true, "not": true, "or": true,
+	"print": true, "printf": true, "println": true, "urlquery": true, "eq": true, "ge": true, "gt": true, "le": true, "lt": true, "ne": true,
+}
+
+// Check parses templates (by name) without executing them and reports undefined functions and templates,
+// functions the policy doesn't allow and define blocks that can't be reached from any of the templates,
+// calls to unsafe functions the policy allows are warnings
+func (t Functions) Check(p *Policy, templates map[string]string) []Problem {
+	pt, problems := parseTemplates(templates)
+	for _, name := range pt.names() {
+		tree := pt.trees[name]
+		walkNodes(tree.Root, func(n parse.Node) {
+			pos, _ := tree.ErrorContext(n)
+			switch n := n.(type) {
+			case *parse.IdentifierNode:
+				info, ok := t[n.Ident]
+				switch {
+				case !ok && !builtinFuncs[n.Ident]:
+					problems = append(problems, Problem{ProblemUndefinedFunction, n.Ident, pos, fmt.Sprintf("function %q not defined", n.Ident), SeverityError})
+				case ok && p.denies(n.Ident, info):
+					problems = append(problems, Problem{ProblemDeniedFunction, n.Ident, pos, fmt.Sprintf("function %q is denied by policy", n.Ident), SeverityError})
+				case ok && !p.Allows(n.Ident, info):
+					problems = append(problems, Problem{ProblemUnsafeFunction, n.Ident, pos, fmt.Sprintf("function %q is unsafe", n.Ident), SeverityError})
+				case ok && info.Unsafe:
+					problems = append(problems, Problem{ProblemUnsafeFunction, n.Ident, pos, fmt.Sprintf("function %q is unsafe, allowed by policy", n.Ident), SeverityWarning})
+				}
+			case *parse.TemplateNode:
+				if _, ok := pt.trees[n.Name]; !ok {
+					problems = append(problems, Problem{ProblemUndefinedTemplate, n.Name, pos, fmt.Sprintf("template %q not defined", n.Name), SeverityError})
+				}
+			}
+		})
+	}
+	reachable := pt.reachable()
+	for _, name := range pt.names() {
+		if !reachable[name] {
+			pos, _ := pt.trees[name].ErrorContext(pt.trees[name].Root)
+			problems = append(problems, Problem{ProblemUnusedDefine, name, pos, fmt.Sprintf("template %q is never used", name), SeverityError})
+		}
+	}
+	return problems
+}
+
+// parseTemplates parses templates into a set of trees as (text/template).Template.Parse would, but without checking functions
+func parseTemplates(templates map[string]string) (*parsedTemplates, []Problem) {
+	var problems []Problem
+	pt := &parsedTemplates{trees: map[string]*parse.Tree{}}
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		trees, err := parseAnyFunction(name, templates[name])
+		if err != nil {
+			problems = append(problems, Problem{Kind: ProblemParse, Name: name, Message: err.Error(), Severity: SeverityError})
+			continue
+		}
+		pt.roots = append(pt.roots, name)
+		for tname, tree := range trees {
+			if old, ok := pt.trees[tname]; !ok || !parse.IsEmptyTree(tree.Root) || parse.IsEmptyTree(old.Root) {
+				pt.trees[tname] = tree
+			}
+		}
+	}
+	return pt, problems
+}
+
+// parseAnyFunction parses text into a set of trees accepting calls to any function: the ones the parser
+// reports as not defined are added to a stub func map, and the text is parsed again
+func parseAnyFunction(name, text string) (map[string]*parse.Tree, error) {
+	stub := make(map[string]interface{}, len(builtinFuncs))
+	for fname := range builtinFuncs {
+		stub[fname] = struct{}{} // the parser only checks that the name maps to something
+	}
+	for {
+		trees := map[string]*parse.Tree{}
+		_, err := parse.New(name).Parse(text, "", "", trees, stub)
+		if err == nil {
+			return trees, nil
+		}
+		m := undefinedFunction.FindStringSubmatch(err.Error())
+		if m == nil {
+			return nil, err
+		}
+		if _, ok := stub[m[1]]; ok {
+			return nil, err
+		}
+		stub[m[1]] = struct{}{}
+	}
+}
+
+func (pt *parsedTemplates) names() []string {
+	out := make([]string, 0, len(pt.trees))
+	for name := range pt.trees {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// reachable marks the templates that can be executed starting from the top level ones
+func (pt *parsedTemplates) reachable() map[string]bool {
+	seen := map[string]bool{}
+	todo := append([]string{}, pt.roots...)
+	for len(todo) > 0 {
+		name := todo[0]
+		todo = todo[1:]
+		tree, ok := pt.trees[name]
+		if seen[name] || !ok {
+			continue
+		}
+		seen[name] = true
+		walkNodes(tree.Root, func(n parse.Node) {
+			if tn, ok := n.(*parse.TemplateNode); ok {
+				todo = append(todo, tn.Name)
+			}
+		})
+	}
+	return seen
+}
+
+// walkNodes calls fn for n and every node below it
+func walkNodes(n parse.Node, fn func(parse.Node)) {
+	fn(n)
+	switch n := n.(type) {
+	case *parse.ListNode:
+		for _, c := range n.Nodes {
+			walkNodes(c, fn)
+		}
+	case *parse.ActionNode:
+		walkNodes(n.Pipe, fn)
+	case *parse.PipeNode:
+		for _, c := range n.Decl {
+			walkNodes(c, fn)
+		}
+		for _, c := range n.Cmds {
+			walkNodes(c, fn)
+		}
+	case *parse.CommandNode:
+		for _, c := range n.Args {
+			walkNodes(c, fn)
+		}
+	case *parse.ChainNode:
+		walkNodes(n.Node, fn)
+	case *parse.IfNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.RangeNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.WithNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.TemplateNode:
+		if n.Pipe != nil {
+			walkNodes(n.Pipe, fn)
+		}
+	}
+}
+
+func walkBranch(b *parse.BranchNode, fn func(parse.Node)) {
+	walkNodes(b.Pipe, fn)
+	walkNodes(b.List, fn)
+	if b.ElseList != nil {
+		walkNodes(b.ElseList, fn)
+	}
+}
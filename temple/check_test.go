@@ -0,0 +1,44 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy *Policy
+		text   string
+		want   []Problem // messages aren't compared
+	}{
+		{"safe", &Policy{}, `{{upper "x"}}`, nil},
+		{"unsafe", &Policy{}, "\n{{cmd \"true\"}}", []Problem{{Kind: ProblemUnsafeFunction, Name: "cmd", Position: "t:2:2", Severity: SeverityError}}},
+		{"unsafe allowed", &Policy{Unsafe: true}, "\n{{cmd \"true\"}}", []Problem{{Kind: ProblemUnsafeFunction, Name: "cmd", Position: "t:2:2", Severity: SeverityWarning}}},
+		{"unsafe allowed by name", &Policy{Allow: []string{"cmd"}}, `{{cmd "true"}}{{env "HOME"}}`, []Problem{
+			{Kind: ProblemUnsafeFunction, Name: "cmd", Position: "t:1:2", Severity: SeverityWarning},
+			{Kind: ProblemUnsafeFunction, Name: "env", Position: "t:1:16", Severity: SeverityError},
+		}},
+		{"denied", &Policy{Unsafe: true, Deny: []string{"cmd"}}, `{{cmd "true"}}`, []Problem{{Kind: ProblemDeniedFunction, Name: "cmd", Position: "t:1:2", Severity: SeverityError}}},
+		{"undefined function", &Policy{}, `{{nope}}`, []Problem{{Kind: ProblemUndefinedFunction, Name: "nope", Position: "t:1:2", Severity: SeverityError}}},
+		{"undefined template", &Policy{}, `{{template "nope"}}`, []Problem{{Kind: ProblemUndefinedTemplate, Name: "nope", Position: "t:1:11", Severity: SeverityError}}},
+		{"unused define", &Policy{}, `{{define "x"}}x{{end}}`, []Problem{{Kind: ProblemUnusedDefine, Name: "x", Position: "t:1:14", Severity: SeverityError}}},
+		{"parse error", &Policy{}, `{{if}}`, []Problem{{Kind: ProblemParse, Name: "t", Severity: SeverityError}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := FnMap.Check(c.policy, map[string]string{"t": c.text})
+			if len(got) != len(c.want) {
+				t.Fatalf("expected %+v, got %+v", c.want, got)
+			}
+			for i, p := range got {
+				p.Message = ""
+				if p != c.want[i] {
+					t.Fatalf("expected %+v, got %+v", c.want[i], p)
+				}
+			}
+		})
+	}
+}
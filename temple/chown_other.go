@@ -0,0 +1,13 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+//go:build windows || plan9
+// +build windows plan9
+
+package temple
+
+import "os"
+
+func chownLike(f *os.File, info os.FileInfo) error {
+	return nil
+}
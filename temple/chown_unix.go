@@ -0,0 +1,25 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package temple
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// chownLike gives f the same owner and group as info
+func chownLike(f *os.File, info os.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if err := f.Chown(int(st.Uid), int(st.Gid)); err != nil {
+		return fmt.Errorf("keeping owner of %s: %w", info.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Context derives the context a template execution runs in from parent, applying the policy timeout
+func (p *Policy) Context(parent context.Context) (context.Context, context.CancelFunc) {
+	if p == nil || p.Limits.Timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, time.Duration(p.Limits.Timeout))
+}
+
+// contextError tells why ctx is done, a deadline set by the policy timeout is reported as a LimitError
+func (p *Policy) contextError(ctx context.Context) error {
+	err := ctx.Err()
+	if p != nil && p.Limits.Timeout > 0 && errors.Is(err, context.DeadlineExceeded) {
+		return &LimitError{"timeout", p.Limits.Timeout}
+	}
+	return err
+}
+
+// withContext wraps f so that calls fail once ctx is done, functions taking a context.Context
+// as first argument get ctx bound to it and are exposed to templates without that argument
+func (p *Policy) withContext(ctx context.Context, f interface{}) interface{} {
+	v := reflect.ValueOf(f)
+	t := v.Type()
+	bind := takesContext(t)
+	if bind {
+		t = withoutContext(t)
+	}
+	return reflect.MakeFunc(t, func(args []reflect.Value) []reflect.Value {
+		if ctx.Err() != nil {
+			return errorResult(t, p.contextError(ctx))
+		}
+		if bind {
+			args = append([]reflect.Value{reflect.ValueOf(&ctx).Elem()}, args...)
+		}
+		return callFn(v, args)
+	}).Interface()
+}
+
+func takesContext(t reflect.Type) bool {
+	return t.NumIn() > 0 && t.In(0) == contextType
+}
+
+// withoutContext returns the type of function t without its leading context.Context argument
+func withoutContext(t reflect.Type) reflect.Type {
+	in := make([]reflect.Type, 0, t.NumIn()-1)
+	for i := 1; i < t.NumIn(); i++ {
+		in = append(in, t.In(i))
+	}
+	out := make([]reflect.Type, 0, t.NumOut())
+	for i := 0; i < t.NumOut(); i++ {
+		out = append(out, t.Out(i))
+	}
+	return reflect.FuncOf(in, out, t.IsVariadic())
+}
+
+// signature is how a function looks from templates
+func signature(f interface{}) string {
+	t := reflect.TypeOf(f)
+	if takesContext(t) {
+		t = withoutContext(t)
+	}
+	return t.String()
+}
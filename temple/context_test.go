@@ -0,0 +1,49 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCanceledRender(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done() // answers only once the client gives up
+	}))
+	defer srv.Close()
+	e := NewEngine(WithPolicy(&Policy{Unsafe: true}))
+	cases := []struct {
+		name  string
+		text  string
+		after time.Duration // cancel after, before the render if 0
+	}{
+		{"cmd", `{{cmd "sleep" "5"}}`, 50 * time.Millisecond},
+		{"http", `{{(http "GET" "` + srv.URL + `" "" nil).StatusCode}}`, 50 * time.Millisecond},
+		{"before", `{{cmd "sleep" "5"}}`, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			if c.after > 0 {
+				time.AfterFunc(c.after, cancel)
+			} else {
+				cancel()
+			}
+			start := time.Now()
+			err := e.Render(ctx, []Template{{c.name, c.text}}, nil, ioutil.Discard)
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Fatalf("the render went on for %s after it was canceled", elapsed)
+			}
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected the render to be canceled, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+	FormatEnv  = "env"
+
+	FormatNDJSON = "ndjson"
+	FormatCSV    = "csv"
+)
+
+var (
+	envLine  = regexp.MustCompile(`^(export\s+)?[A-Za-z_][A-Za-z0-9_.]*=`)
+	tomlLine = regexp.MustCompile(`^(\[\[?[^\]]+\]\]?|[A-Za-z0-9_.\-"']+\s*=\s*.+)$`)
+)
+
+// LoadDataFile reads a JSON, YAML, TOML or dotenv file into a map
+func LoadDataFile(p string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	out, err := ParseData(b, DetectDataFormat(p, b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return out, nil
+}
+
+// DetectDataFormat guesses the format of b from the file extension, falling back to sniffing the contents
+func DetectDataFormat(name string, b []byte) string {
+	base := strings.ToLower(filepath.Base(name))
+	switch filepath.Ext(base) {
+	case ".json":
+		return FormatJSON
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	case ".env":
+		return FormatEnv
+	}
+	if base == ".env" || strings.HasPrefix(base, ".env.") {
+		return FormatEnv
+	}
+	return sniffDataFormat(b)
+}
+
+func sniffDataFormat(b []byte) string {
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && (b[0] == '{' || b[0] == '[') && json.Valid(b) {
+		return FormatJSON
+	}
+	isEnv, isTOML := true, true
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		t := strings.TrimSpace(scanner.Text())
+		if t == "" || strings.HasPrefix(t, "#") {
+			continue
+		}
+		if !envLine.MatchString(t) {
+			isEnv = false
+		}
+		if !tomlLine.MatchString(t) {
+			isTOML = false
+		}
+	}
+	switch {
+	case isEnv:
+		return FormatEnv
+	case isTOML:
+		return FormatTOML
+	}
+	return FormatYAML
+}
+
+// ParseData decodes b (in the given format) to a map, the top level must be an object
+func ParseData(b []byte, format string) (out map[string]interface{}, err error) {
+	out = make(map[string]interface{})
+	switch format {
+	case FormatJSON:
+		err = json.Unmarshal(b, &out)
+	case FormatYAML:
+		err = yaml.Unmarshal(b, &out)
+	case FormatTOML:
+		err = toml.Unmarshal(b, &out)
+	case FormatEnv:
+		out, err = parseEnv(b)
+	default:
+		err = fmt.Errorf("unsupported data format %q", format)
+	}
+	if err != nil {
+		if kind := topLevelKind(b, format); kind != "" {
+			return nil, fmt.Errorf("the top level must be an object, not %s", kind)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// topLevelKind tells what the top level of b is when it decodes, but not to an object
+func topLevelKind(b []byte, format string) string {
+	var v interface{}
+	switch format {
+	case FormatJSON:
+		if json.Unmarshal(b, &v) != nil {
+			return ""
+		}
+	case FormatYAML:
+		if yaml.Unmarshal(b, &v) != nil {
+			return ""
+		}
+	default:
+		return ""
+	}
+	switch v.(type) {
+	case map[string]interface{}, map[interface{}]interface{}:
+		return ""
+	case []interface{}:
+		return "a list"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case nil:
+		return "null"
+	}
+	return "a number"
+}
+
+func parseEnv(b []byte) (map[string]interface{}, error) {
+	out := make(map[string]interface{})
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		t := strings.TrimSpace(scanner.Text())
+		if t == "" || strings.HasPrefix(t, "#") {
+			continue
+		}
+		t = strings.TrimSpace(strings.TrimPrefix(t, "export "))
+		i := strings.Index(t, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", n)
+		}
+		k, v := strings.TrimSpace(t[:i]), strings.TrimSpace(t[i+1:])
+		switch {
+		case strings.HasPrefix(v, `"`):
+			end := 1
+			for ; end < len(v) && (v[end] != '"' || v[end-1] == '\\'); end++ {
+			}
+			if end >= len(v) {
+				return nil, fmt.Errorf("line %d: unterminated quoted value", n)
+			}
+			uq, err := strconv.Unquote(v[:end+1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			v = uq
+		case strings.HasPrefix(v, "'"):
+			end := strings.Index(v[1:], "'")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated quoted value", n)
+			}
+			v = v[1 : end+1]
+		default:
+			if c := strings.Index(v, " #"); c >= 0 {
+				v = strings.TrimSpace(v[:c])
+			}
+		}
+		out[k] = v
+	}
+	return out, scanner.Err()
+}
+
+// MergeData deep-merges src over dst and returns dst: nested maps are merged, anything else in src replaces what's in dst
+func MergeData(dst, src map[string]interface{}) map[string]interface{} {
+	if dst == nil {
+		dst = make(map[string]interface{})
+	}
+	for k, v := range src {
+		sm, sok := v.(map[string]interface{})
+		dm, dok := dst[k].(map[string]interface{})
+		if sok && dok {
+			dst[k] = MergeData(dm, sm)
+			continue
+		}
+		dst[k] = v
+	}
+	return dst
+}
+
+// ParseInput decodes b as JSON, YAML, NDJSON or CSV, format "auto" (or "") detects which one it is.
+// CSV input is returned as a list of maps keyed by the header row.
+func ParseInput(b []byte, format string) (out interface{}, err error) {
+	if format == "" || format == "auto" {
+		if format, err = DetectInputFormat(b); err != nil {
+			return nil, err
+		}
+	}
+	switch format {
+	case FormatJSON:
+		err = json.Unmarshal(b, &out)
+	case FormatYAML:
+		err = yaml.Unmarshal(b, &out)
+	case FormatNDJSON:
+		out, err = parseNDJSON(b)
+	case FormatCSV:
+		out, err = parseCSV(b)
+	default:
+		err = fmt.Errorf("unsupported input format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DetectInputFormat tells JSON, NDJSON, CSV and YAML apart, failing when the input fits more than one of them
+func DetectInputFormat(b []byte) (string, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return "", fmt.Errorf("no input to detect the format of")
+	}
+	if json.Valid(b) {
+		return FormatJSON, nil
+	}
+	if docs, err := parseNDJSON(b); err == nil && len(docs) > 1 {
+		return FormatNDJSON, nil
+	}
+	var candidates []string
+	if records, err := csv.NewReader(bytes.NewReader(b)).ReadAll(); err == nil && len(records) > 1 && len(records[0]) > 1 {
+		candidates = append(candidates, FormatCSV)
+	}
+	var y interface{}
+	if err := yaml.Unmarshal(b, &y); err == nil {
+		switch y.(type) {
+		case map[string]interface{}, map[interface{}]interface{}, []interface{}:
+			candidates = append(candidates, FormatYAML)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return "", fmt.Errorf("input is not valid %s, %s, %s or %s", FormatJSON, FormatNDJSON, FormatCSV, FormatYAML)
+	case 1:
+		return candidates[0], nil
+	}
+	return "", fmt.Errorf("ambiguous input, could be any of %v: specify the format explicitly", candidates)
+}
+
+func parseNDJSON(b []byte) ([]interface{}, error) {
+	var out []interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, len(b)+1)
+	for n := 1; scanner.Scan(); n++ {
+		t := bytes.TrimSpace(scanner.Bytes())
+		if len(t) == 0 {
+			continue
+		}
+		var v interface{}
+		if err := json.Unmarshal(t, &v); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		out = append(out, v)
+	}
+	return out, scanner.Err()
+}
+
+func parseCSV(b []byte) ([]map[string]string, error) {
+	records, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 1 {
+		return nil, fmt.Errorf("missing csv header")
+	}
+	out := make([]map[string]string, 0, len(records)-1)
+	for _, rec := range records[1:] {
+		row := make(map[string]string, len(rec))
+		for i, field := range rec {
+			row[records[0][i]] = field
+		}
+		out = append(out, row)
+	}
+	return out, nil
+}
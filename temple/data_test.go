@@ -0,0 +1,68 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDataTopLevel(t *testing.T) {
+	for _, c := range []struct {
+		text, format, err string
+	}{
+		{`{"a": 1}`, FormatJSON, ""},
+		{`[1, 2]`, FormatJSON, "the top level must be an object, not a list"},
+		{`"a"`, FormatJSON, "the top level must be an object, not a string"},
+		{`{"a": 1`, FormatJSON, "unexpected end of JSON input"},
+	} {
+		_, err := ParseData([]byte(c.text), c.format)
+		if (c.err == "" && err != nil) || (c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err))) {
+			t.Errorf("%s %q: expected error %q, got %v", c.format, c.text, c.err, err)
+		}
+	}
+}
+
+func TestDetectInputFormat(t *testing.T) {
+	for _, c := range []struct {
+		text, format, err string
+	}{
+		{`{"a": 1}`, FormatJSON, ""},
+		{" [1, 2]\n", FormatJSON, ""},
+		{"{\"a\": 1}\n{\"a\": 2}\n", FormatNDJSON, ""},
+		{"a,b\n1,2\n", FormatCSV, ""},
+		{"  \n", "", "no input"},
+		{"just some text", "", "input is not valid"},
+	} {
+		format, err := DetectInputFormat([]byte(c.text))
+		if format != c.format || (c.err == "" && err != nil) || (c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err))) {
+			t.Errorf("%q: expected %q and error %q, got %q and %v", c.text, c.format, c.err, format, err)
+		}
+	}
+}
+
+func TestParseInput(t *testing.T) {
+	for _, c := range []struct {
+		text, format string
+		want         interface{}
+		err          string
+	}{
+		{`{"a": 1}`, "auto", map[string]interface{}{"a": 1.0}, ""},
+		{`["a", "b"]`, "", []interface{}{"a", "b"}, ""},
+		{"{\"a\": 1}\n\n{\"a\": 2}\n", FormatNDJSON, []interface{}{map[string]interface{}{"a": 1.0}, map[string]interface{}{"a": 2.0}}, ""},
+		{"{\"a\": 1}\n{\"a\": \n", FormatNDJSON, nil, "line 2"},
+		{"a,b\n1,2\n3,4\n", "auto", []map[string]string{{"a": "1", "b": "2"}, {"a": "3", "b": "4"}}, ""},
+		{"a,b\n", FormatCSV, []map[string]string{}, ""},
+		{"", FormatCSV, nil, "missing csv header"},
+		{`{}`, "xml", nil, "unsupported input format"},
+	} {
+		got, err := ParseInput([]byte(c.text), c.format)
+		if (c.err == "" && err != nil) || (c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err))) {
+			t.Errorf("%s %q: expected error %q, got %v", c.format, c.text, c.err, err)
+		} else if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s %q: expected %#v, got %#v", c.format, c.text, c.want, got)
+		}
+	}
+}
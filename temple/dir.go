@@ -0,0 +1,157 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	htmlTpl "html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	textTpl "text/template"
+)
+
+// RenderDir mirrors the tree in src to dst. Files ending with suffix are templates: they're all parsed
+// in the same set, so they share their define blocks, and are executed to a file named without the suffix.
+// Other files are copied as they are. Paths are templates too, a path component rendering to "" skips that file or directory.
+// The engine limits apply to the whole tree, and its policy to the files read and written.
+func (e *Engine) RenderDir(ctx context.Context, src, dst, suffix string, data interface{}) error {
+	type entry struct {
+		rel  string
+		info os.FileInfo
+	}
+	var entries []entry
+	p := e.policy
+	src, err := p.resolve(src, false)
+	if err != nil {
+		return err
+	}
+	if dst, err = p.resolve(dst, true); err != nil {
+		return err
+	}
+	ctx, cancel := p.Context(ctx)
+	defer cancel()
+	funcs := e.funcMap(ctx, p.budget(), e.tracer, nil)
+	var parse func(name, text string) error
+	var execute func(w io.Writer, name string) error
+	if e.html {
+		tpl := htmlTpl.New(filepath.Base(src)).Funcs(funcs)
+		parse = func(name, text string) error {
+			_, err := tpl.New(name).Parse(text)
+			return err
+		}
+		execute = func(w io.Writer, name string) error { return tpl.ExecuteTemplate(w, name, data) }
+	} else {
+		tpl := textTpl.New(filepath.Base(src)).Funcs(funcs)
+		parse = func(name, text string) error {
+			_, err := tpl.New(name).Parse(text)
+			return err
+		}
+		execute = func(w io.Writer, name string) error { return tpl.ExecuteTemplate(w, name, data) }
+	}
+	err = filepath.Walk(src, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, fpath)
+		if err != nil || rel == "." {
+			return err
+		}
+		entries = append(entries, entry{rel, info})
+		if info.Mode().IsRegular() && strings.HasSuffix(rel, suffix) {
+			if fpath, err = p.resolve(fpath, false); err != nil {
+				return err
+			}
+			text, err := fload(fpath)
+			if err != nil {
+				return err
+			}
+			return parse(filepath.ToSlash(rel), text)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	for _, en := range entries {
+		isTemplate := en.info.Mode().IsRegular() && strings.HasSuffix(en.rel, suffix)
+		name, err := renderPath(funcs, en.rel, data)
+		if err != nil {
+			return err
+		}
+		if isTemplate {
+			name = strings.TrimSuffix(name, suffix)
+		}
+		if name == "" || strings.HasSuffix(name, string(filepath.Separator)) {
+			continue
+		}
+		out := filepath.Join(dst, name)
+		if !within(filepath.Clean(dst), out) {
+			return fmt.Errorf("%s: rendered path %s is outside of %s", en.rel, name, dst)
+		}
+		if out, err = p.resolve(out, true); err != nil {
+			return fmt.Errorf("%s: %w", en.rel, err)
+		}
+		switch mode := en.info.Mode(); {
+		case mode.IsDir():
+			err = os.MkdirAll(out, mode.Perm())
+		case mode&os.ModeSymlink != 0:
+			var target string
+			if target, err = os.Readlink(filepath.Join(src, en.rel)); err == nil {
+				os.Remove(out)
+				err = os.Symlink(target, out)
+			}
+		case isTemplate:
+			buf := new(bytes.Buffer)
+			err = p.Execute(ctx, buf, func(w io.Writer) error {
+				return execute(w, filepath.ToSlash(en.rel))
+			})
+			if err == nil {
+				err = WriteFile(out, buf, WriteOptions{WriteTruncate, mode.Perm(), false})
+			}
+		case mode.IsRegular():
+			var fpath string
+			var f *os.File
+			if fpath, err = p.resolve(filepath.Join(src, en.rel), false); err == nil {
+				if f, err = os.Open(fpath); err == nil {
+					err = WriteFile(out, f, WriteOptions{WriteTruncate, mode.Perm(), false})
+					f.Close()
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", en.rel, err)
+		}
+	}
+	return nil
+}
+
+// renderPath executes each component of rel as a template, returning "" if any of them renders to nothing
+func renderPath(funcs map[string]interface{}, rel string, data interface{}) (string, error) {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i, part := range parts {
+		if !strings.Contains(part, "{{") {
+			continue
+		}
+		tpl, err := textTpl.New(rel).Funcs(funcs).Parse(part)
+		if err != nil {
+			return "", err
+		}
+		buf := new(bytes.Buffer)
+		if err = tpl.Execute(buf, data); err != nil {
+			return "", err
+		}
+		if buf.Len() < 1 {
+			return "", nil
+		}
+		parts[i] = buf.String()
+	}
+	return filepath.FromSlash(strings.Join(parts, "/")), nil
+}
@@ -0,0 +1,89 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderDir(t *testing.T) {
+	base := t.TempDir()
+	src := filepath.Join(base, "src")
+	files := map[string]string{
+		"{{if .Never}}defs{{end}}.tmpl": `{{define "greet"}}hello {{.Name}}{{end}}`,
+		"{{.Name}}.conf.tmpl":           `{{template "greet" .}}`,
+		"{{.Dir}}/page.html.tmpl":       `<p>{{.Tag}}</p>`,
+		"{{if .Never}}skipped{{end}}/x": "never copied",
+		"static.txt":                    "{{.Name}} as is",
+	}
+	for name, text := range files {
+		fpath := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fpath, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := map[string]interface{}{"Name": "world", "Dir": "site", "Tag": "<b>"}
+	cases := []struct {
+		name string
+		opts []Option
+		dst  string
+		want map[string]string // the files in dst, or nil with err
+		err  string
+	}{
+		{"text", nil, "text", map[string]string{"world.conf": "hello world", "site/page.html": "<p><b></p>", "static.txt": "{{.Name}} as is"}, ""},
+		{"html", []Option{WithHTML(true)}, "html", map[string]string{"world.conf": "hello world", "site/page.html": "<p>&lt;b&gt;</p>", "static.txt": "{{.Name}} as is"}, ""},
+		{"read-only", []Option{WithPolicy(&Policy{ReadOnly: true})}, "ro", nil, "read-only policy"},
+		{"outside of the root", []Option{WithPolicy(&Policy{Root: src})}, "../outside", nil, "is outside of"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dst := filepath.Join(base, c.dst)
+			if strings.HasPrefix(c.dst, "..") {
+				dst = c.dst
+			}
+			err := NewEngine(c.opts...).RenderDir(context.Background(), src, dst, ".tmpl", data)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("expected an error containing %q, got %v", c.err, err)
+				}
+				if _, err = os.Stat(filepath.Join(base, strings.TrimPrefix(c.dst, "../"))); !os.IsNotExist(err) {
+					t.Fatalf("expected nothing written, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			err = filepath.Walk(dst, func(fpath string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				b, err := ioutil.ReadFile(fpath)
+				rel, _ := filepath.Rel(dst, fpath)
+				got[filepath.ToSlash(rel)] = strings.TrimSpace(string(b))
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(c.want) {
+				t.Fatalf("expected %v, got %v", c.want, got)
+			}
+			for name, text := range c.want {
+				if got[name] != text {
+					t.Errorf("%s: expected %q, got %q", name, text, got[name])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,405 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"context"
+	"fmt"
+	htmlTpl "html/template"
+	"io"
+	"path"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	textTpl "text/template"
+	"text/template/parse"
+	"time"
+)
+
+type (
+	// Engine renders templates with a set of functions under a policy. It holds no mutable state
+	// once created, so it's safe for concurrent use and independent of the package globals.
+	Engine struct {
+		funcs    Functions
+		policy   *Policy
+		limits   *Limits
+		html     bool
+		tracer   Tracer
+		loader   Loader
+		cassette *Cassette
+		safer    *Engine // see safe
+	}
+	// Option configures an Engine
+	Option func(*Engine)
+	// Tracer is told about every template function call, from as many goroutines as there are renders
+	Tracer func(c *Call)
+	// Loader reads the text of a template by name, for Engine.Load
+	Loader func(name string) (string, error)
+	// Call is a template function call, as seen by a Tracer. A Call without Function is
+	// the execution of Template as a whole, reported after the calls it made.
+	Call struct {
+		Function string
+		Args     []interface{} // after the policy checks, as the function got them
+		Output   interface{}
+		Err      error
+		Start    time.Time
+		Duration time.Duration
+		Render   uint64 // the execution the call is part of, concurrent renders have different ones
+		Template string // the template (or define block) the call is in
+		Position string // name:line:col of the call in the template text
+	}
+	// Template is a named template text
+	Template struct {
+		Name string
+		Text string
+	}
+	// Parsed is a set of templates parsed by an Engine, ready to be executed any number of times
+	Parsed struct {
+		e     *Engine
+		name  string // the template executed
+		text  *textTpl.Template
+		html  *htmlTpl.Template
+		sites callSites
+	}
+)
+
+// renders counts executions, to tell apart the calls of concurrent ones
+var renders uint64
+
+// WithFunctions sets the functions templates can call, FnMap by default
+func WithFunctions(f Functions) Option {
+	return func(e *Engine) { e.funcs = f }
+}
+
+// WithPolicy sets the function policy, by default only safe functions are available
+func WithPolicy(p *Policy) Option {
+	return func(e *Engine) { e.policy = p }
+}
+
+// WithLimits overrides the limits of the policy
+func WithLimits(l Limits) Option {
+	return func(e *Engine) { e.limits = &l }
+}
+
+// WithHTML makes the engine use html/template, escaping output for HTML
+func WithHTML(html bool) Option {
+	return func(e *Engine) { e.html = html }
+}
+
+// WithTracer adds a function called after each template function call, and after each execution
+func WithTracer(t Tracer) Option {
+	return func(e *Engine) {
+		if prev := e.tracer; prev != nil {
+			e.tracer = func(c *Call) {
+				prev(c)
+				t(c)
+			}
+			return
+		}
+		e.tracer = t
+	}
+}
+
+// WithCassette records the calls to side-effecting functions to c, or replays them from it
+func WithCassette(c *Cassette) Option {
+	return func(e *Engine) { e.cassette = c }
+}
+
+// WithLoader sets how Engine.Load reads templates, by default they're files resolved with the policy
+func WithLoader(l Loader) Option {
+	return func(e *Engine) { e.loader = l }
+}
+
+func NewEngine(opts ...Option) *Engine {
+	e := &Engine{funcs: FnMap, policy: &Policy{}}
+	for _, opt := range opts {
+		opt(e)
+	}
+	e.funcs = e.funcs.Clone()
+	if e.policy != nil || e.limits != nil {
+		p := Policy{}
+		if e.policy != nil {
+			p = *e.policy
+		}
+		if e.limits != nil {
+			p.Limits = *e.limits
+		}
+		e.policy = &p
+	}
+	if e.loader == nil {
+		e.loader = func(name string) (string, error) {
+			fpath, err := e.policy.resolve(name, false)
+			if err != nil {
+				return "", err
+			}
+			return fload(fpath)
+		}
+	}
+	e.safer = e.withoutUnsafe()
+	return e
+}
+
+// Functions returns the functions of the engine, allowed by the policy or not
+func (e *Engine) Functions() Functions {
+	return e.funcs.Clone()
+}
+
+// Policy returns a copy of the engine policy
+func (e *Engine) Policy() *Policy {
+	if e.policy == nil {
+		return nil
+	}
+	p := *e.policy
+	return &p
+}
+
+// safe returns a copy of e with a policy that allows no unsafe function, the same one every time
+func (e *Engine) safe() *Engine {
+	if e.safer == nil {
+		return e.withoutUnsafe()
+	}
+	return e.safer
+}
+
+func (e *Engine) withoutUnsafe() *Engine {
+	x := *e
+	p := Policy{}
+	if e.policy != nil {
+		p = *e.policy
+	}
+	p.Unsafe, p.Allow = false, nil
+	x.policy = &p
+	x.safer = &x
+	return &x
+}
+
+// Load reads templates with the engine loader, naming them by base name as they're known once parsed
+func (e *Engine) Load(names ...string) ([]Template, error) {
+	out := make([]Template, 0, len(names))
+	for _, name := range names {
+		text, err := e.loader(name)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, Template{path.Base(name), text})
+	}
+	return out, nil
+}
+
+// Render parses templates and executes the first one with data, writing to w.
+// The others, and all define blocks, can be called from it with {{template "name"}}.
+func (e *Engine) Render(ctx context.Context, templates []Template, data interface{}, w io.Writer) error {
+	pt, err := e.Parse(templates...)
+	if err != nil {
+		return err
+	}
+	return pt.Execute(ctx, data, w)
+}
+
+// Parse parses templates in a single set, the first one is the one Execute runs
+func (e *Engine) Parse(templates ...Template) (*Parsed, error) {
+	if len(templates) < 1 {
+		return nil, fmt.Errorf("no templates found")
+	}
+	pt := &Parsed{e: e, name: templates[0].Name}
+	funcs := e.funcMap(context.Background(), nil, nil, nil) // only their names and types matter for parsing
+	var err error
+	if e.html {
+		pt.html = htmlTpl.New(pt.name).Funcs(funcs)
+		for i, t := range templates {
+			tpl := pt.html // the first one is parsed in the root, Clone would replace it with an empty one
+			if i > 0 {
+				tpl = tpl.New(t.Name)
+			}
+			if _, err = tpl.Parse(t.Text); err != nil {
+				return nil, err
+			}
+		}
+		if e.tracer != nil {
+			for _, tpl := range pt.html.Templates() {
+				pt.sites = pt.sites.add(tpl.Tree, e.funcs)
+			}
+		}
+		return pt, nil
+	}
+	pt.text = textTpl.New(pt.name).Funcs(funcs)
+	for i, t := range templates {
+		tpl := pt.text
+		if i > 0 {
+			tpl = tpl.New(t.Name)
+		}
+		if _, err = tpl.Parse(t.Text); err != nil {
+			return nil, err
+		}
+	}
+	if e.tracer != nil {
+		for _, tpl := range pt.text.Templates() {
+			pt.sites = pt.sites.add(tpl.Tree, e.funcs)
+		}
+	}
+	return pt, nil
+}
+
+// Lookup returns pt executing template name instead, false if there's none so named
+func (pt *Parsed) Lookup(name string) (*Parsed, bool) {
+	if (pt.html != nil && pt.html.Lookup(name) == nil) || (pt.text != nil && pt.text.Lookup(name) == nil) {
+		return nil, false
+	}
+	x := *pt
+	x.name = name
+	return &x, true
+}
+
+// calls lists the functions the executed template can call, itself or through the templates it runs
+func (pt *Parsed) calls() []string {
+	tree := func(name string) *parse.Tree {
+		if pt.html != nil {
+			if t := pt.html.Lookup(name); t != nil {
+				return t.Tree
+			}
+		} else if t := pt.text.Lookup(name); t != nil {
+			return t.Tree
+		}
+		return nil
+	}
+	found, seen := map[string]bool{}, map[string]bool{pt.name: true}
+	for todo := []string{pt.name}; len(todo) > 0; todo = todo[1:] {
+		t := tree(todo[0])
+		if t == nil || t.Root == nil {
+			continue
+		}
+		walkNodes(t.Root, func(n parse.Node) {
+			switch n := n.(type) {
+			case *parse.IdentifierNode:
+				name := n.Ident
+				if site, ok := pt.sites[name]; ok {
+					name = site.Function
+				}
+				found[name] = true
+			case *parse.TemplateNode:
+				if !seen[n.Name] {
+					seen[n.Name] = true
+					todo = append(todo, n.Name)
+				}
+			}
+		})
+	}
+	out := make([]string, 0, len(found))
+	for name := range found {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Execute runs the templates with data within the engine limits, writing to w.
+// Functions are canceled when ctx is done.
+func (pt *Parsed) Execute(ctx context.Context, data interface{}, w io.Writer) error {
+	p := pt.e.policy
+	ctx, cancel := p.Context(ctx)
+	defer cancel()
+	tracer := pt.e.tracer
+	render := &Call{Start: time.Now(), Render: atomic.AddUint64(&renders, 1), Template: pt.name}
+	if tracer != nil {
+		tracer = func(c *Call) {
+			c.Render = render.Render
+			pt.e.tracer(c)
+		}
+	}
+	funcs := pt.e.funcMap(ctx, p.budget(), tracer, pt.sites)
+	var exec func(io.Writer) error
+	if pt.html != nil {
+		tpl, err := pt.html.Clone()
+		if err != nil {
+			return err
+		}
+		tpl.Funcs(funcs)
+		exec = func(w io.Writer) error { return tpl.ExecuteTemplate(w, pt.name, data) }
+	} else {
+		tpl, err := pt.text.Clone()
+		if err != nil {
+			return err
+		}
+		tpl.Funcs(funcs)
+		exec = func(w io.Writer) error { return tpl.ExecuteTemplate(w, pt.name, data) }
+	}
+	err := pt.sites.restore(p.Execute(ctx, w, exec))
+	if tracer != nil {
+		render.Duration, render.Err = time.Since(render.Start), err
+		tracer(render)
+	}
+	return err
+}
+
+// Check reports the problems in templates without executing them, see Functions.Check
+func (e *Engine) Check(templates []Template) []Problem {
+	return e.funcs.Check(e.policy, templateMap(templates))
+}
+
+// Inspect reports what templates use without executing them, see Functions.Inspect
+func (e *Engine) Inspect(templates []Template) (*Report, []Problem) {
+	return e.funcs.Inspect(templateMap(templates))
+}
+
+func templateMap(templates []Template) map[string]string {
+	out := make(map[string]string, len(templates))
+	for _, t := range templates {
+		out[t.Name] = t.Text
+	}
+	return out
+}
+
+// funcMap builds the functions allowed by the policy, bound to ctx, checked and traced
+func (e *Engine) funcMap(ctx context.Context, budget *callBudget, tracer Tracer, sites callSites) map[string]interface{} {
+	return e.funcs.funcMap(ctx, e.policy, budget, tracer, e.cassette, sites)
+}
+
+func (t Functions) funcMap(ctx context.Context, p *Policy, budget *callBudget, tracer Tracer, cassette *Cassette, sites callSites) map[string]interface{} {
+	m := make(map[string]interface{}, len(t)+len(sites))
+	ctx = context.WithValue(ctx, functionsKey{}, t) // for fns
+	ctx = context.WithValue(ctx, policyKey{}, p)    // for http, to check redirects
+	wrap := func(name string, info Function, tracer Tracer) interface{} {
+		base := info.base(name) // aliases are checked, budgeted and recorded as the function they stand for
+		return budget.wrap(base, p.guard(base, traced(name, info, cassette.wrap(base, info, p.withContext(ctx, info.Fn)), tracer)))
+	}
+	for name, info := range t {
+		if p.Allows(name, info) {
+			m[name] = wrap(name, info, tracer)
+		}
+	}
+	for site, s := range sites {
+		if info, ok := t[s.Function]; ok && p.Allows(s.Function, info) {
+			m[site] = wrap(s.Function, info, s.tracer(tracer))
+		}
+	}
+	return m
+}
+
+// traced wraps f to report its calls to tracer, with the sensitive values of info redacted
+func traced(name string, info Function, f interface{}, tracer Tracer) interface{} {
+	if tracer == nil {
+		return f
+	}
+	v := reflect.ValueOf(f)
+	t := v.Type()
+	return reflect.MakeFunc(t, func(args []reflect.Value) []reflect.Value {
+		c := &Call{Function: name, Args: make([]interface{}, 0, len(args)), Start: time.Now()}
+		for _, a := range args {
+			c.Args = append(c.Args, a.Interface())
+		}
+		out := callFn(v, args)
+		c.Duration = time.Since(c.Start)
+		n := len(out)
+		if n > 0 && t.Out(n-1) == errorType {
+			c.Err, _ = out[n-1].Interface().(error)
+			n--
+		}
+		if n > 0 {
+			c.Output = out[0].Interface()
+		}
+		c.Args, c.Output = info.redact(c.Args, c.Output)
+		tracer(c)
+		return out
+	}).Interface()
+}
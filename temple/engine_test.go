@@ -0,0 +1,137 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestEngineRender(t *testing.T) {
+	funcs := FnMap.Clone()
+	if err := funcs.Register("hello", Function{Fn: func(s string) string { return "hello " + s }}); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name      string
+		opts      []Option
+		templates []Template
+		data      interface{}
+		want, err string
+	}{
+		{"default", nil, []Template{{"t", `{{upper .}}`}}, "x", "X", ""},
+		{"unsafe not allowed", nil, []Template{{"t", `{{env "HOME"}}`}}, nil, "", `function "env" not defined`},
+		{"unsafe allowed", []Option{WithPolicy(&Policy{Allow: []string{"env"}})}, []Template{{"t", `{{env "XPRINT_ENGINE_TEST"}}`}}, nil, "set", ""},
+		{"functions", []Option{WithFunctions(funcs)}, []Template{{"t", `{{hello .}}`}}, "x", "hello x", ""},
+		{"text", nil, []Template{{"t", `{{.}}`}}, "<b>", "<b>", ""},
+		{"html", []Option{WithHTML(true)}, []Template{{"t", `{{.}}`}}, "<b>", "&lt;b&gt;", ""},
+		{"first executed", nil, []Template{{"a", `A{{template "b"}}`}, {"b", `B`}}, nil, "AB", ""},
+		{"shared defines", []Option{WithHTML(true)}, []Template{{"a", `{{template "x" .}}`}, {"b", `{{define "x"}}<i>{{.}}</i>{{end}}`}}, "<b>", "<i>&lt;b&gt;</i>", ""},
+		{"limits", []Option{WithLimits(Limits{MaxOutput: 2})}, []Template{{"t", `xyz`}}, nil, "", "maxoutput"},
+		{"none", nil, nil, nil, "", "no templates"},
+	}
+	os.Setenv("XPRINT_ENGINE_TEST", "set")
+	defer os.Unsetenv("XPRINT_ENGINE_TEST")
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := new(strings.Builder)
+			err := NewEngine(c.opts...).Render(context.Background(), c.templates, c.data, b)
+			if (c.err == "" && err != nil) || (c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err))) {
+				t.Fatalf("expected error %q, got %v", c.err, err)
+			}
+			if c.err == "" && b.String() != c.want {
+				t.Fatalf("expected %q, got %q", c.want, b.String())
+			}
+		})
+	}
+}
+
+func TestEngineLookup(t *testing.T) {
+	pt, err := NewEngine().Parse(Template{"a", `A{{define "x"}}X{{.}}{{end}}`}, Template{"b", `B{{template "x" 1}}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name, want string
+		ok         bool
+	}{
+		{"a", "A", true},
+		{"b", "BX1", true},
+		{"x", "X2", true},
+		{"c", "", false},
+	}
+	for _, c := range cases {
+		x, ok := pt.Lookup(c.name)
+		if ok != c.ok {
+			t.Fatalf("%s: expected found %v, got %v", c.name, c.ok, ok)
+		}
+		if !ok {
+			continue
+		}
+		b := new(strings.Builder)
+		if err := x.Execute(context.Background(), 2, b); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != c.want {
+			t.Fatalf("%s: expected %q, got %q", c.name, c.want, b.String())
+		}
+	}
+}
+
+func TestEngineConcurrentExecute(t *testing.T) {
+	var mu sync.Mutex
+	renders := map[uint64]int{}
+	e := NewEngine(WithTracer(func(c *Call) {
+		if c.Function == "upper" {
+			mu.Lock()
+			renders[c.Render]++
+			mu.Unlock()
+		}
+	}))
+	pt, err := e.Parse(Template{"t", `{{range .}}{{upper .}}{{end}}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := []string{fmt.Sprint("a", i), fmt.Sprint("b", i)}
+			b := new(strings.Builder)
+			if err := pt.Execute(context.Background(), data, b); err != nil {
+				errs <- err
+			} else if want := fmt.Sprint("A", i, "B", i); b.String() != want {
+				errs <- fmt.Errorf("expected %q, got %q", want, b.String())
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if len(renders) != n {
+		t.Fatalf("expected %d renders, got %d", n, len(renders))
+	}
+	for id, calls := range renders {
+		if calls != 2 {
+			t.Fatalf("expected 2 calls in render %d, got %d", id, calls)
+		}
+	}
+}
+
+func TestEnginePolicyCopy(t *testing.T) {
+	e := NewEngine(WithPolicy(&Policy{Allow: []string{"env"}}))
+	e.Policy().Unsafe = true
+	if p := e.Policy(); p.Unsafe {
+		t.Fatal("changing the returned policy changed the engine")
+	}
+}
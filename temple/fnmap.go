@@ -4,10 +4,9 @@
 package temple
 
 import (
-	"encoding/json"
+	"context"
 	htmlTpl "html/template"
 	"path/filepath"
-	"reflect"
 	"sort"
 	"strings"
 	textTpl "text/template"
@@ -15,46 +14,55 @@ import (
 )
 
 type (
-	fn struct {
-		_fn         interface{} `json:"-"`
+	// Function is a template function and what's known about it
+	Function struct {
+		Fn          interface{} `json:"-"`
 		Description string      `json:"description"`
-		Signature   string      `json:"function"`
+		Signature   string      `json:"function"` // filled in from Fn
 		Unsafe      bool        `json:"unsafe"`
+		Params      []Param     `json:"params,omitempty"` // as many as the arguments templates call Fn with, or none
+		Returns     string      `json:"returns,omitempty"`
+		Examples    []string    `json:"examples,omitempty"`
+		Categories  []string    `json:"categories,omitempty"`
+		AliasOf     string      `json:"alias_of,omitempty"` // set by Functions.Alias
+		Redact      *Redaction  `json:"redact,omitempty"`   // arguments and result kept out of traces and logs
 	}
-	templeFnMap map[string]fn
+	Param struct {
+		Name string `json:"name"`
+		Doc  string `json:"doc,omitempty"`
+	}
+	// Functions is a set of template functions by name
+	Functions map[string]Function
 )
 
-// Add a function to the list of available ones (use before FuncMap())
-func (t templeFnMap) Fn(name, description string, funct interface{}, unsafe bool) {
-	t[name] = fn{
-		funct,
-		description,
-		reflect.TypeOf(funct).String(),
-		unsafe,
+// Add a function to the list of available ones (use before FuncMap()), replacing any with the same name
+func (t Functions) Fn(name, description string, funct interface{}, unsafe bool) {
+	t[name] = Function{
+		Fn:          funct,
+		Description: description,
+		Signature:   signature(funct),
+		Unsafe:      unsafe,
 	}
 }
 
-func (t templeFnMap) BuildFuncMap(addUnsafeFuncs bool) textTpl.FuncMap {
-	m := make(textTpl.FuncMap)
-	for name, info := range t {
-		if !info.Unsafe || addUnsafeFuncs {
-			m[name] = info._fn
-		}
-	}
-	return m
+func (t Functions) BuildFuncMap(ctx context.Context, p *Policy) textTpl.FuncMap {
+	return t.funcMap(ctx, p, p.budget(), nil, nil, nil)
 }
 
-func (t templeFnMap) BuildHTMLFuncMap(addUnsafeFuncs bool) htmlTpl.FuncMap {
-	m := make(htmlTpl.FuncMap)
+func (t Functions) BuildHTMLFuncMap(ctx context.Context, p *Policy) htmlTpl.FuncMap {
+	return t.funcMap(ctx, p, p.budget(), nil, nil, nil)
+}
+
+// Clone returns a copy of t, to add or replace functions without affecting t
+func (t Functions) Clone() Functions {
+	out := make(Functions, len(t))
 	for name, info := range t {
-		if !info.Unsafe || addUnsafeFuncs {
-			m[name] = info._fn
-		}
+		out[name] = info
 	}
-	return m
+	return out
 }
 
-func (t templeFnMap) UnsafeFuncs() []string {
+func (t Functions) UnsafeFuncs() []string {
 	out := []string{}
 	for name, info := range t {
 		if info.Unsafe {
@@ -65,11 +73,6 @@ func (t templeFnMap) UnsafeFuncs() []string {
 	return out
 }
 
-func (t templeFnMap) HelpText() string {
-	b, _ := json.MarshalIndent(t, "", "  ")
-	return string(b)
-}
-
 /* src/text/template/funcs.go
 func builtins() FuncMap {
 	return FuncMap{
@@ -98,230 +101,338 @@ func builtins() FuncMap {
 }
 */
 
-var (
-	defaultFnMapHelpText string
-	FnMap                = templeFnMap{
-		"b64dec": {
-			b64dec,
-			"base64 decode",
-			reflect.TypeOf(b64dec).String(),
-			false,
-		},
-		"b64enc": {
-			b64enc,
-			"base64 encode",
-			reflect.TypeOf(b64enc).String(),
-			false,
-		},
-		"cmd": {
-			cmd,
-			"execute a command on local host",
-			reflect.TypeOf(cmd).String(),
-			true,
-		},
-		"decrypt": {
-			decrypt,
-			"decrypt data with AES_GCM: $1 ctxt, $2 base64 key, $3 AAD",
-			reflect.TypeOf(decrypt).String(),
-			false,
-		},
-		"duration": {
-			time.ParseDuration,
-			"time.ParseDuration",
-			reflect.TypeOf(time.ParseDuration).String(),
-			false,
-		},
-		"encrypt": {
-			encrypt,
-			"encrypt data with AES_GCM: $1 ptxt, $2 base64 key, $3 AAD",
-			reflect.TypeOf(encrypt).String(),
-			false,
-		},
-		"env": {
-			env,
-			"get environment vars, optionally use a placeholder value $2",
-			reflect.TypeOf(env).String(),
-			true,
-		},
-		"fns": {
-			fns,
-			"get list of available functions",
-			reflect.TypeOf(fns).String(),
-			false,
-		},
-		"fromgob": {
-			fromgob,
-			"gob decode",
-			reflect.TypeOf(fromgob).String(),
-			false,
-		},
-		"fromjson": {
-			fromjson,
-			"json decode",
-			reflect.TypeOf(fromjson).String(),
-			false,
-		},
-		"fromyaml": {
-			fromyaml,
-			"yaml decode",
-			reflect.TypeOf(fromyaml).String(),
-			false,
-		},
-		"gunzip": {
-			_gunzip,
-			"extract GZIP compressed data",
-			reflect.TypeOf(_gunzip).String(),
-			false,
-		},
-		"gzip": {
-			_gzip,
-			"compress with GZIP",
-			reflect.TypeOf(_gzip).String(),
-			false,
-		},
-		"hexdec": {
-			hexdec,
-			"hex decode",
-			reflect.TypeOf(hexdec).String(),
-			false,
-		},
-		"hexenc": {
-			hexenc,
-			"hex encode",
-			reflect.TypeOf(hexenc).String(),
-			false,
-		},
-		"http": {
-			_http,
-			"HEAD|GET|POST, url, body(raw), headers",
-			reflect.TypeOf(_http).String(),
-			true,
-		},
-		"is": {
-			is,
-			"check if $1 is all |upper(case), |lower(case), |int, |float, |float32, |bool or ==$2",
-			reflect.TypeOf(is).String(),
-			false,
-		},
-		"join": {
-			strings.Join,
-			"strings.Join",
-			reflect.TypeOf(strings.Join).String(),
-			false,
-		},
-		"lower": {
-			strings.ToLower,
-			"strings.ToLower",
-			reflect.TypeOf(strings.ToLower).String(),
-			false,
-		},
-		"math": {
-			math,
-			"math operations (+, -, *, /, %, max, min)",
-			reflect.TypeOf(math).String(),
-			false,
-		},
-		"mapadd": {
-			add,
-			"add value $2 to map or slice $1, map needs $3 for value's key in map",
-			reflect.TypeOf(add).String(),
-			false,
-		},
-		"pathbase": {
-			filepath.Base,
-			"filepath.Base",
-			reflect.TypeOf(filepath.Base).String(),
-			false,
-		},
-		"pathext": {
-			filepath.Ext,
-			"filepath.Ext",
-			reflect.TypeOf(filepath.Ext).String(),
-			false,
-		},
-		"random": {
-			Random,
-			"generate a $1 sized []byte filled with bytes from crypto.Rand",
-			reflect.TypeOf(Random).String(),
-			false,
-		},
-		"rawfile": {
-			rawfile,
-			"read raw bytes from a file",
-			reflect.TypeOf(rawfile).String(),
-			true,
-		},
-		"split": {
-			strings.Split,
-			"strings.Split",
-			reflect.TypeOf(strings.Split).String(),
-			false,
-		},
-		"string": {
-			stringify,
-			"convert int/bool to string, retype []byte to string (handle with care)",
-			reflect.TypeOf(stringify).String(),
-			false,
-		},
-		"textfile": {
-			textfile,
-			"read a file as a string",
-			reflect.TypeOf(textfile).String(),
-			true,
-		},
-		"timestamp": {
-			timestamp,
-			"$1 for timezone (default UTC)",
-			reflect.TypeOf(timestamp).String(),
-			false,
-		},
-		"togob": {
-			togob,
-			"gob encode",
-			reflect.TypeOf(togob).String(),
-			false,
-		},
-		"tojson": {
-			tojson,
-			"json encode",
-			reflect.TypeOf(tojson).String(),
-			false,
-		},
-		"toyaml": {
-			toyaml,
-			"yaml encode",
-			reflect.TypeOf(toyaml).String(),
-			false,
-		},
-		"trimprefix": {
-			strings.TrimPrefix,
-			"strings.TrimPrefix",
-			reflect.TypeOf(strings.TrimPrefix).String(),
-			false,
-		},
-		"trimsuffix": {
-			strings.TrimSuffix,
-			"strings.TrimSuffix",
-			reflect.TypeOf(strings.TrimSuffix).String(),
-			false,
-		},
-		"upper": {
-			strings.ToUpper,
-			"strings.ToUpper",
-			reflect.TypeOf(strings.ToUpper).String(),
-			false,
-		},
-		"userinput": {
-			userinput,
-			"get interactive user input (needs a terminal), if $2 bool is provided and true, term.ReadPassword is used. $1 is used as hint",
-			reflect.TypeOf(userinput).String(),
-			true,
-		},
-		"writefile": {
-			writefile,
-			"store data to a file (append if it already exists)",
-			reflect.TypeOf(writefile).String(),
-			true,
-		},
+var FnMap = Functions{
+	"b64dec": {
+		Fn:          b64dec,
+		Description: "base64 decode",
+		Params:      []Param{{"in", "base64 string, []byte or io.Reader"}},
+		Returns:     "the decoded bytes",
+		Examples:    []string{`{{b64dec "aGVsbG8=" | string}}`},
+		Categories:  []string{"encoding"},
+	},
+	"b64enc": {
+		Fn:          b64enc,
+		Description: "base64 encode",
+		Params:      []Param{{"in", "string, []byte or io.Reader"}},
+		Returns:     "the base64 string",
+		Examples:    []string{`{{b64enc "hello"}}`},
+		Categories:  []string{"encoding"},
+	},
+	"cmd": {
+		Fn:          cmd,
+		Description: "execute a command on local host",
+		Unsafe:      true,
+		Params:      []Param{{"prog", "program to run, looked up in PATH"}, {"args", "its arguments"}},
+		Returns:     "the finished command: .Stdout and .Stderr (trimmed), .ProcessState",
+		Examples:    []string{`{{(cmd "uname" "-r").Stdout}}`},
+		Categories:  []string{"system"},
+	},
+	"decrypt": {
+		Fn:          decrypt,
+		Description: "decrypt data with AES_GCM",
+		Params:      []Param{{"in", "nonce and ciphertext, as encrypt returns them"}, {"b64key", "base64 16, 24 or 32 bytes key"}, {"aad", "additional authenticated data given to encrypt"}},
+		Returns:     "the plaintext",
+		Examples:    []string{`{{decrypt (b64dec .Data.secret) .Data.key "" | string}}`},
+		Categories:  []string{"crypto"},
+		Redact:      &Redaction{Params: []string{"b64key"}, Output: true},
+	},
+	"duration": {
+		Fn:          time.ParseDuration,
+		Description: "time.ParseDuration",
+		Params:      []Param{{"s", "duration like 1h30m or 250ms"}},
+		Returns:     "a time.Duration",
+		Examples:    []string{`{{(duration "1h30m").Minutes}}`},
+		Categories:  []string{"time"},
+	},
+	"encrypt": {
+		Fn:          encrypt,
+		Description: "encrypt data with AES_GCM",
+		Params:      []Param{{"in", "plaintext: string, []byte or io.Reader"}, {"b64key", "base64 16, 24 or 32 bytes key"}, {"aad", "additional authenticated data, can be empty"}},
+		Returns:     "the nonce followed by the ciphertext",
+		Examples:    []string{`{{encrypt "secret" .Data.key "" | b64enc}}`},
+		Categories:  []string{"crypto"},
+		Redact:      &Redaction{Params: []string{"in", "b64key"}},
+	},
+	"env": {
+		Fn:          env,
+		Description: "get environment vars",
+		Unsafe:      true,
+		Params:      []Param{{"in", "variable name"}, {"or", "placeholder value if it's not set"}},
+		Returns:     "the value of the variable",
+		Examples:    []string{`{{env "HOME"}}`, `{{env "EDITOR" "vi"}}`},
+		Categories:  []string{"system"},
+		Redact:      &Redaction{Output: true}, // environment variables often hold credentials
+	},
+	"fns": {
+		Fn:          fns,
+		Description: "get list of available functions",
+		Returns:     "their documentation",
+		Examples:    []string{`{{fns}}`},
+		Categories:  []string{"meta"},
+	},
+	"fromgob": {
+		Fn:          fromgob,
+		Description: "gob decode",
+		Params:      []Param{{"in", "gob []byte, string or io.Reader"}},
+		Returns:     "the decoded value",
+		Examples:    []string{`{{togob .Data | fromgob}}`},
+		Categories:  []string{"encoding"},
+	},
+	"fromjson": {
+		Fn:          fromjson,
+		Description: "json decode",
+		Params:      []Param{{"in", "json string, []byte or io.Reader"}},
+		Returns:     "the decoded value",
+		Examples:    []string{`{{(textfile "config.json" | fromjson).name}}`},
+		Categories:  []string{"encoding"},
+	},
+	"fromyaml": {
+		Fn:          fromyaml,
+		Description: "yaml decode",
+		Params:      []Param{{"in", "yaml string, []byte or io.Reader"}},
+		Returns:     "the decoded value",
+		Examples:    []string{`{{(textfile "config.yaml" | fromyaml).name}}`},
+		Categories:  []string{"encoding"},
+	},
+	"gunzip": {
+		Fn:          _gunzip,
+		Description: "extract GZIP compressed data",
+		Params:      []Param{{"in", "compressed []byte, string or io.Reader"}},
+		Returns:     "the extracted bytes",
+		Examples:    []string{`{{rawfile "notes.gz" | gunzip | string}}`},
+		Categories:  []string{"compression"},
+	},
+	"gzip": {
+		Fn:          _gzip,
+		Description: "compress with GZIP",
+		Params:      []Param{{"in", "string, []byte or io.Reader"}},
+		Returns:     "the compressed bytes",
+		Examples:    []string{`{{gzip .Stdin | b64enc}}`},
+		Categories:  []string{"compression"},
+	},
+	"hexdec": {
+		Fn:          hexdec,
+		Description: "hex decode",
+		Params:      []Param{{"in", "hex string, []byte or io.Reader"}},
+		Returns:     "the decoded bytes",
+		Examples:    []string{`{{rawfile "key.hex" | hexdec | b64enc}}`},
+		Categories:  []string{"encoding"},
+	},
+	"hexenc": {
+		Fn:          hexenc,
+		Description: "hex encode",
+		Params:      []Param{{"in", "string, []byte or io.Reader"}},
+		Returns:     "the hex string",
+		Examples:    []string{`{{hexenc "hi"}}`},
+		Categories:  []string{"encoding"},
+	},
+	"http": {
+		Fn:          _http,
+		Description: "make an HTTP request",
+		Unsafe:      true,
+		Params:      []Param{{"method", "HEAD, GET, POST..."}, {"url", ""}, {"body", "raw body: string, []byte or io.Reader"}, {"headers", "request headers, can be nil"}},
+		Returns:     "the *http.Response, its .Body can be piped to string",
+		Examples:    []string{`{{(http "GET" "https://example.com" "" nil).Body | string}}`},
+		Categories:  []string{"network"},
+		Redact:      &Redaction{Params: []string{"headers"}},
+	},
+	"is": {
+		Fn:          is,
+		Description: "check what a string is",
+		Params:      []Param{{"s", ""}, {"what", "|upper(case), |lower(case), |int, |float, |float32, |bool or a string s must be equal to"}},
+		Returns:     "true if s is all what",
+		Examples:    []string{`{{if is "42" "|int"}}number{{end}}`},
+		Categories:  []string{"strings"},
+	},
+	"join": {
+		Fn:          strings.Join,
+		Description: "strings.Join",
+		Params:      []Param{{"elems", "[]string"}, {"sep", "separator"}},
+		Returns:     "the joined string",
+		Examples:    []string{`{{join .Args ", "}}`},
+		Categories:  []string{"strings"},
+	},
+	"lower": {
+		Fn:          strings.ToLower,
+		Description: "strings.ToLower",
+		Params:      []Param{{"s", ""}},
+		Returns:     "s in lower case",
+		Examples:    []string{`{{lower "XPRINT"}}`},
+		Categories:  []string{"strings"},
+	},
+	"math": {
+		Fn:          math,
+		Description: "math operations",
+		Params:      []Param{{"b", "left operand"}, {"x", "+ (add), - (sub), x (mul), / (div), % (mod), max or min"}, {"a", "right operand"}},
+		Returns:     "the result, typed like b",
+		Examples:    []string{`{{math 6 "x" 7}}`, `{{math (len .Args) "max" 1}}`},
+		Categories:  []string{"math"},
+	},
+	"mapadd": {
+		Fn:          mapadd,
+		Description: "add a value to a map or slice",
+		Params:      []Param{{"in", "map or []interface{}"}, {"value", ""}, {"key", "key of value, maps need it"}},
+		Returns:     "the map or slice",
+		Examples:    []string{`{{(mapadd .Data "xprint" "name").name}}`},
+		Categories:  []string{"data"},
+	},
+	"pathbase": {
+		Fn:          filepath.Base,
+		Description: "filepath.Base",
+		Params:      []Param{{"path", ""}},
+		Returns:     "the last element of path",
+		Examples:    []string{`{{pathbase "/etc/hosts"}}`},
+		Categories:  []string{"paths"},
+	},
+	"pathext": {
+		Fn:          filepath.Ext,
+		Description: "filepath.Ext",
+		Params:      []Param{{"path", ""}},
+		Returns:     "the extension of path, with the dot",
+		Examples:    []string{`{{pathext "notes.txt"}}`},
+		Categories:  []string{"paths"},
+	},
+	"random": {
+		Fn:          Random,
+		Description: "generate random bytes with crypto/rand",
+		Params:      []Param{{"size", "how many"}},
+		Returns:     "the random bytes",
+		Examples:    []string{`{{random 16 | hexenc}}`},
+		Categories:  []string{"crypto"},
+	},
+	"rawfile": {
+		Fn:          rawfile,
+		Description: "read raw bytes from a file",
+		Unsafe:      true,
+		Params:      []Param{{"in", "file path"}},
+		Returns:     "the file content",
+		Examples:    []string{`{{rawfile "logo.png" | b64enc}}`},
+		Categories:  []string{"files"},
+	},
+	"reveal": {
+		Fn:          reveal,
+		Description: "get back the value wrapped by secret",
+		Params:      []Param{{"in", "a secret, other values are returned as they are"}},
+		Returns:     "the wrapped value",
+		Examples:    []string{`{{$key := secret .Data.key}}{{encrypt .Stdin (reveal $key) "" | b64enc}}`},
+		Categories:  []string{"secrets"},
+		Redact:      &Redaction{Output: true},
+	},
+	"secret": {
+		Fn:          secret,
+		Description: "wrap a value so that it prints as [REDACTED], in the output, traces and logs",
+		Params:      []Param{{"in", "any value"}},
+		Returns:     "the wrapped value, reveal unwraps it",
+		Examples:    []string{`{{$pw := userinput "password" true | secret}}`},
+		Categories:  []string{"secrets"},
+		Redact:      &Redaction{Params: []string{"in"}},
+	},
+	"split": {
+		Fn:          strings.Split,
+		Description: "strings.Split",
+		Params:      []Param{{"s", ""}, {"sep", "separator"}},
+		Returns:     "the substrings between separators",
+		Examples:    []string{`{{range split "a,b,c" ","}}{{.}}{{end}}`},
+		Categories:  []string{"strings"},
+	},
+	"string": {
+		Fn:          stringify,
+		Description: "convert int/bool to string, retype []byte to string (handle with care)",
+		Params:      []Param{{"in", "string, int, bool, []byte or io.Reader"}},
+		Returns:     "the string",
+		Examples:    []string{`{{b64dec "aGk=" | string}}`},
+		Categories:  []string{"strings"},
+	},
+	"textfile": {
+		Fn:          textfile,
+		Description: "read a file as a string",
+		Unsafe:      true,
+		Params:      []Param{{"in", "file path"}},
+		Returns:     "the file content",
+		Examples:    []string{`{{textfile "/etc/hostname"}}`},
+		Categories:  []string{"files"},
+	},
+	"timestamp": {
+		Fn:          timestamp,
+		Description: "current time in UTC",
+		Params:      []Param{{"tz", "name for the time zone, the offset stays 0"}},
+		Returns:     "a time.Time",
+		Examples:    []string{`{{timestamp.Format "2006-01-02"}}`},
+		Categories:  []string{"time"},
+	},
+	"togob": {
+		Fn:          togob,
+		Description: "gob encode",
+		Params:      []Param{{"in", "any value gob can encode"}},
+		Returns:     "the gob bytes",
+		Examples:    []string{`{{togob .Data | b64enc}}`},
+		Categories:  []string{"encoding"},
+	},
+	"tojson": {
+		Fn:          tojson,
+		Description: "json encode",
+		Params:      []Param{{"in", "any value"}},
+		Returns:     "the json string",
+		Examples:    []string{`{{tojson .Data}}`},
+		Categories:  []string{"encoding"},
+	},
+	"toyaml": {
+		Fn:          toyaml,
+		Description: "yaml encode",
+		Params:      []Param{{"in", "any value"}},
+		Returns:     "the yaml string",
+		Examples:    []string{`{{toyaml .Data}}`},
+		Categories:  []string{"encoding"},
+	},
+	"trimprefix": {
+		Fn:          strings.TrimPrefix,
+		Description: "strings.TrimPrefix",
+		Params:      []Param{{"s", ""}, {"prefix", ""}},
+		Returns:     "s without prefix",
+		Examples:    []string{`{{trimprefix "v1.2.3" "v"}}`},
+		Categories:  []string{"strings"},
+	},
+	"trimsuffix": {
+		Fn:          strings.TrimSuffix,
+		Description: "strings.TrimSuffix",
+		Params:      []Param{{"s", ""}, {"suffix", ""}},
+		Returns:     "s without suffix",
+		Examples:    []string{`{{trimsuffix "notes.txt" ".txt"}}`},
+		Categories:  []string{"strings"},
+	},
+	"upper": {
+		Fn:          strings.ToUpper,
+		Description: "strings.ToUpper",
+		Params:      []Param{{"s", ""}},
+		Returns:     "s in upper case",
+		Examples:    []string{`{{upper "xprint"}}`},
+		Categories:  []string{"strings"},
+	},
+	"userinput": {
+		Fn:          userinput,
+		Description: "get interactive user input (needs a terminal)",
+		Unsafe:      true,
+		Params:      []Param{{"title", "hint shown to the user"}, {"hidden", "true to read without echo, with term.ReadPassword"}},
+		Returns:     "what the user typed",
+		Examples:    []string{`{{userinput "name"}}`, `{{userinput "password" true}}`},
+		Categories:  []string{"interactive"},
+		Redact:      &Redaction{Output: true, When: "hidden"},
+	},
+	"writefile": {
+		Fn:          writefile,
+		Description: "store data to a file",
+		Unsafe:      true,
+		Params:      []Param{{"in", "string, []byte or io.Reader"}, {"fpath", "file path"}, {"opts", "append (default), truncate or atomic (replace), mkdir (create parent directories), octal file mode"}},
+		Returns:     "an empty string",
+		Examples:    []string{`{{writefile .Stdin "out/copy.txt" "atomic" "mkdir" "0644"}}`},
+		Categories:  []string{"files"},
+	},
+}
+
+func init() {
+	for name, f := range FnMap {
+		f.Signature = signature(f.Fn)
+		FnMap[name] = f
 	}
-)
+	builtins = FnMap
+}
@@ -6,6 +6,7 @@ package temple
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -36,9 +37,9 @@ func timestamp(tz ...string) time.Time {
 	return time.Now().UTC()
 }
 
-func _http(method, url string, body interface{}, headers map[string]string) (out *http.Response, err error) {
+func _http(ctx context.Context, method, url string, body interface{}, headers map[string]string) (out *http.Response, err error) {
 	method = strings.ToUpper(method)
-	defer trackUsage("http", true, out, err, method, url, headers, body)
+	defer trackUsage("http", true, out, err, method, url, body, headers)
 	var bodyr io.Reader
 	switch t := body.(type) {
 	case string:
@@ -51,14 +52,16 @@ func _http(method, url string, body interface{}, headers map[string]string) (out
 		err = fmt.Errorf("invalid argument %T, supported types: io.Reader, string or []byte", t)
 	}
 	var req *http.Request
-	req, err = http.NewRequest(method, url, bodyr)
+	req, err = http.NewRequestWithContext(ctx, method, url, bodyr)
 	if err != nil {
 		return nil, err
 	}
 	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
-	out, err = http.DefaultClient.Do(req)
+	p, _ := ctx.Value(policyKey{}).(*Policy) // set when building the func map
+	client := &http.Client{CheckRedirect: p.checkRedirect}
+	out, err = client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -384,9 +387,9 @@ func textfile(in string) (out string, err error) {
 	return out, nil
 }
 
-func writefile(in interface{}, fpath string) (out string, err error) {
-	defer trackUsage("writefile", true, "", err, in, fpath)
-	f, err := os.OpenFile(fpath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.FileMode(0600))
+func writefile(in interface{}, fpath string, opts ...string) (out string, err error) {
+	defer trackUsage("writefile", true, "", err, in, fpath, opts)
+	o, err := ParseWriteOptions(opts...)
 	if err != nil {
 		return "", err
 	}
@@ -402,7 +405,7 @@ func writefile(in interface{}, fpath string) (out string, err error) {
 		err = fmt.Errorf("invalid argument %T, supported types: io.Reader, string or []byte", t)
 		return "", err
 	}
-	_, err = io.Copy(f, todo)
+	err = WriteFile(fpath, todo, o)
 	return "", err
 }
 
@@ -641,9 +644,9 @@ func (c *cmdBuffers) Stderr() string {
 	return strings.TrimSpace(c.stderr.String())
 }
 
-func cmd(prog string, args ...string) (out *cmdBuffers, err error) {
+func cmd(ctx context.Context, prog string, args ...string) (out *cmdBuffers, err error) {
 	defer trackUsage("cmd", true, &out, err, prog, args[:])
-	x := exec.Command(prog, args...)
+	x := exec.CommandContext(ctx, prog, args...)
 	out = &cmdBuffers{
 		new(bytes.Buffer),
 		new(bytes.Buffer),
@@ -684,6 +687,7 @@ func consumeReader(in interface{}) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func fns() string {
-	return defaultFnMapHelpText
+func fns(ctx context.Context) string {
+	t, _ := ctx.Value(functionsKey{}).(Functions) // set when building the func map
+	return t.HelpText()
 }
@@ -0,0 +1,199 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	HelpTable    = "table"
+	HelpDetail   = "detail"
+	HelpMarkdown = "markdown"
+	HelpMan      = "man"
+	HelpJSON     = "json"
+)
+
+// Filter returns the functions whose name or one of the categories matches one of patterns (as in path.Match),
+// all of them if there are no patterns
+func (t Functions) Filter(patterns ...string) Functions {
+	if len(patterns) < 1 {
+		return t.Clone()
+	}
+	out := Functions{}
+	for name, f := range t {
+		for _, p := range patterns {
+			if match(p, name) || matchAny(p, f.Categories) {
+				out[name] = f
+				break
+			}
+		}
+	}
+	return out
+}
+
+func match(pattern, s string) bool {
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
+
+func matchAny(pattern string, list []string) bool {
+	for _, s := range list {
+		if match(pattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteHelp documents the functions in t to w in one of the Help* formats
+func (t Functions) WriteHelp(w io.Writer, format string) error {
+	switch format {
+	case HelpTable, "":
+		return t.writeTable(w)
+	case HelpDetail:
+		_, err := io.WriteString(w, t.HelpText())
+		return err
+	case HelpMarkdown:
+		return t.writeMarkdown(w)
+	case HelpMan:
+		return t.writeMan(w)
+	case HelpJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(t)
+	}
+	return fmt.Errorf("unknown help format %s, use one of: %s, %s, %s, %s, %s", format, HelpTable, HelpDetail, HelpMarkdown, HelpMan, HelpJSON)
+}
+
+func (t Functions) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tCATEGORIES\tUNSAFE\tDESCRIPTION")
+	for _, name := range t.Names() {
+		f := t[name]
+		unsafe := ""
+		if f.Unsafe {
+			unsafe = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", name, strings.Join(f.Categories, ","), unsafe, f.Description)
+	}
+	return tw.Flush()
+}
+
+func (t Functions) writeMarkdown(w io.Writer) error {
+	b := new(strings.Builder)
+	fmt.Fprint(b, "# xprint template functions\n\n")
+	fmt.Fprint(b, "| function | categories | description |\n|---|---|---|\n")
+	for _, name := range t.Names() {
+		f := t[name]
+		fmt.Fprintf(b, "| [%s](#%s) | %s | %s |\n", name, name, mdCell(strings.Join(f.Categories, ", ")), mdCell(f.Description))
+	}
+	for _, name := range t.Names() {
+		f := t[name]
+		fmt.Fprintf(b, "\n## %s\n\n```\n%s\n```\n\n%s\n", name, f.Usage(name), f.Description)
+		if f.AliasOf != "" {
+			fmt.Fprintf(b, "\nAlias of [%s](#%s).\n", f.AliasOf, f.AliasOf)
+		}
+		if f.Unsafe {
+			fmt.Fprint(b, "\n**Unsafe**: only available with `-u` or a policy allowing it.\n")
+		}
+		if len(f.Params) > 0 {
+			fmt.Fprint(b, "\n| parameter | description |\n|---|---|\n")
+			for _, p := range f.Params {
+				fmt.Fprintf(b, "| `%s` | %s |\n", p.Name, mdCell(p.Doc))
+			}
+		}
+		if f.Returns != "" {
+			fmt.Fprintf(b, "\nReturns %s.\n", f.Returns)
+		}
+		if len(f.Examples) > 0 {
+			fmt.Fprint(b, "\n```\n")
+			for _, e := range f.Examples {
+				fmt.Fprintln(b, e)
+			}
+			fmt.Fprint(b, "```\n")
+		}
+		if meta := helpMeta(f); meta != "" {
+			fmt.Fprintf(b, "\n_%s_\n", meta)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func mdCell(s string) string {
+	return strings.ReplaceAll(s, "|", `\|`)
+}
+
+func (t Functions) writeMan(w io.Writer) error {
+	b := new(strings.Builder)
+	fmt.Fprint(b, ".TH XPRINT-FUNCTIONS 7 \"\" xprint \"xprint template functions\"\n")
+	fmt.Fprint(b, ".SH NAME\nxprint-functions \\- functions available to xprint templates\n.SH FUNCTIONS\n")
+	for _, name := range t.Names() {
+		f := t[name]
+		fmt.Fprintf(b, ".SS %s\n.nf\n%s\n.fi\n.PP\n%s\n", name, roff(f.Usage(name)), roff(f.Description))
+		if f.AliasOf != "" {
+			fmt.Fprintf(b, ".PP\nAlias of \\fB%s\\fR.\n", f.AliasOf)
+		}
+		if f.Unsafe {
+			fmt.Fprint(b, ".PP\nUnsafe: only available with \\fB\\-u\\fR or a policy allowing it.\n")
+		}
+		for _, p := range f.Params {
+			doc := roff(p.Doc)
+			if doc == "" {
+				doc = `\&`
+			}
+			fmt.Fprintf(b, ".TP\n.I %s\n%s\n", p.Name, doc)
+		}
+		if f.Returns != "" {
+			fmt.Fprintf(b, ".PP\nReturns %s.\n", roff(f.Returns))
+		}
+		if len(f.Examples) > 0 {
+			fmt.Fprint(b, ".PP\n.nf\n")
+			for _, e := range f.Examples {
+				fmt.Fprintln(b, roff(e))
+			}
+			fmt.Fprint(b, ".fi\n")
+		}
+		if meta := helpMeta(f); meta != "" {
+			fmt.Fprintf(b, ".PP\n%s\n", roff(meta))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// roff escapes s for a man page line
+func roff(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\e`)
+	s = strings.ReplaceAll(s, "-", `\-`)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
+
+// helpMeta is the line with categories and redactions of f
+func helpMeta(f Function) string {
+	var meta []string
+	if len(f.Categories) > 0 {
+		meta = append(meta, "categories: "+strings.Join(f.Categories, ", "))
+	}
+	if r := f.Redact; r != nil {
+		redacted := append([]string{}, r.Params...)
+		if r.Output {
+			redacted = append(redacted, "result")
+		}
+		if r.When != "" {
+			redacted = append(redacted, "when "+r.When)
+		}
+		meta = append(meta, "redacted in traces: "+strings.Join(redacted, " "))
+	}
+	return strings.Join(meta, ", ")
+}
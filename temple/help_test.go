@@ -0,0 +1,107 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func helpFunctions(t *testing.T) Functions {
+	funcs := Functions{}
+	if err := funcs.Register("pick", Function{
+		Fn:          func(a, b string) string { return a },
+		Description: "first of a|b",
+		Params:      []Param{{"a", "the one"}, {"b", "-other"}},
+		Returns:     "a",
+		Examples:    []string{`{{pick "x" "y"}}`},
+		Categories:  []string{"strings"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := funcs.Register("run", Function{
+		Fn:          func(s string) string { return s },
+		Description: "runs s",
+		Unsafe:      true,
+		Params:      []Param{{"s", ""}},
+		Categories:  []string{"os"},
+		Redact:      &Redaction{Params: []string{"s"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := funcs.Alias("choose", "pick"); err != nil {
+		t.Fatal(err)
+	}
+	return funcs
+}
+
+func TestFunctionsFilter(t *testing.T) {
+	funcs := helpFunctions(t)
+	cases := []struct {
+		patterns []string
+		want     []string
+	}{
+		{nil, []string{"choose", "pick", "run"}},
+		{[]string{"pick"}, []string{"pick"}},
+		{[]string{"strings"}, []string{"choose", "pick"}},
+		{[]string{"r*", "o?"}, []string{"run"}},
+		{[]string{"nope"}, []string{}},
+	}
+	for _, c := range cases {
+		if got := funcs.Filter(c.patterns...).Names(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: expected %v, got %v", c.patterns, c.want, got)
+		}
+	}
+}
+
+func TestWriteHelp(t *testing.T) {
+	funcs := helpFunctions(t)
+	cases := []struct {
+		format string
+		want   []string // lines in the output
+		err    string
+	}{
+		{HelpTable, []string{"NAME    CATEGORIES  UNSAFE  DESCRIPTION", "choose  strings             first of a|b", "run     os          yes     runs s"}, ""},
+		{"", []string{"NAME    CATEGORIES  UNSAFE  DESCRIPTION"}, ""},
+		{HelpDetail, []string{"choose(a string, b string) string", "\talias of pick", "\tb: -other", "\texample: {{pick \"x\" \"y\"}}"}, ""},
+		{HelpMarkdown, []string{"| [choose](#choose) | strings | first of a\\|b |", "Alias of [pick](#pick).", "| `b` | -other |", "**Unsafe**: only available with `-u` or a policy allowing it.", "_categories: os, redacted in traces: s_"}, ""},
+		{HelpMan, []string{".SS choose", "Alias of \\fBpick\\fR.", "\\-other", ".I s", "\\&", "categories: os, redacted in traces: s"}, ""},
+		{"xml", nil, "unknown help format xml"},
+	}
+	for _, c := range cases {
+		t.Run(c.format, func(t *testing.T) {
+			b := new(strings.Builder)
+			err := funcs.WriteHelp(b, c.format)
+			if (c.err == "" && err != nil) || (c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err))) {
+				t.Fatalf("expected error %q, got %v", c.err, err)
+			}
+			lines := map[string]bool{}
+			for _, line := range strings.Split(b.String(), "\n") {
+				lines[line] = true
+			}
+			for _, line := range c.want {
+				if !lines[line] {
+					t.Errorf("missing line %q in\n%s", line, b)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteHelpJSON(t *testing.T) {
+	funcs := helpFunctions(t)
+	b := new(strings.Builder)
+	if err := funcs.WriteHelp(b, HelpJSON); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]Function
+	if err := json.Unmarshal([]byte(b.String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got["choose"].AliasOf != "pick" || !got["run"].Unsafe || got["pick"].Signature != "func(string, string) string" {
+		t.Fatalf("unexpected json help %s", b)
+	}
+}
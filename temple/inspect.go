@@ -0,0 +1,122 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"sort"
+	"strings"
+	"text/template/parse"
+)
+
+type (
+	// Report is what can be told about templates without executing them
+	Report struct {
+		Functions []FunctionUse `json:"functions"`
+		Files     []LiteralUse  `json:"files"`
+		URLs      []LiteralUse  `json:"urls"`
+		Commands  []LiteralUse  `json:"commands"`
+		Env       []LiteralUse  `json:"env"`
+		Fields    []string      `json:"fields"` // fields read from the data (or from the dot, in range/with blocks)
+	}
+	FunctionUse struct {
+		Name      string   `json:"name"`
+		Unsafe    bool     `json:"unsafe"`
+		Defined   bool     `json:"defined"`
+		Positions []string `json:"positions"`
+	}
+	// LiteralUse is a call to a file, http, cmd or env function with a constant path, url, command or name
+	LiteralUse struct {
+		Function string   `json:"function"`
+		Args     []string `json:"args"` // as written in the template: constant strings are quoted
+		Position string   `json:"position"`
+	}
+)
+
+// Inspect lists the functions templates call, the constant file paths, urls, commands and environment variables
+// they use and the data fields they read
+func (t Functions) Inspect(templates map[string]string) (*Report, []Problem) {
+	pt, problems := parseTemplates(templates)
+	r := &Report{
+		Functions: []FunctionUse{},
+		Files:     []LiteralUse{},
+		URLs:      []LiteralUse{},
+		Commands:  []LiteralUse{},
+		Env:       []LiteralUse{},
+		Fields:    []string{},
+	}
+	funcs := map[string]*FunctionUse{}
+	fields := map[string]bool{}
+	for _, name := range pt.names() {
+		tree := pt.trees[name]
+		walkNodes(tree.Root, func(n parse.Node) {
+			switch n := n.(type) {
+			case *parse.IdentifierNode:
+				pos, _ := tree.ErrorContext(n)
+				fu, ok := funcs[n.Ident]
+				if !ok {
+					info, defined := t[n.Ident]
+					fu = &FunctionUse{Name: n.Ident, Unsafe: info.Unsafe, Defined: defined || builtinFuncs[n.Ident]}
+					funcs[n.Ident] = fu
+				}
+				fu.Positions = append(fu.Positions, pos)
+			case *parse.FieldNode:
+				fields["."+strings.Join(n.Ident, ".")] = true
+			case *parse.VariableNode:
+				if len(n.Ident) > 1 {
+					fields[strings.TrimPrefix(strings.Join(n.Ident, "."), "$")] = true
+				}
+			case *parse.PipeNode:
+				for i, c := range n.Cmds {
+					if len(c.Args) < 1 {
+						continue
+					}
+					ident, ok := c.Args[0].(*parse.IdentifierNode)
+					if !ok {
+						continue
+					}
+					args := append([]parse.Node{}, c.Args[1:]...)
+					if i > 0 && len(n.Cmds[i-1].Args) == 1 { // piped in as the last argument
+						args = append(args, n.Cmds[i-1].Args[0])
+					}
+					r.addLiteral(tree, c, ident.Ident, t[ident.Ident].base(ident.Ident), args)
+				}
+			}
+		})
+	}
+	for _, fu := range funcs {
+		r.Functions = append(r.Functions, *fu)
+	}
+	sort.Slice(r.Functions, func(i, j int) bool { return r.Functions[i].Name < r.Functions[j].Name })
+	for f := range fields {
+		r.Fields = append(r.Fields, f)
+	}
+	sort.Strings(r.Fields)
+	return r, problems
+}
+
+// addLiteral records the constant policy argument of a call to fname, base is the function it stands for if it's an alias
+func (r *Report) addLiteral(tree *parse.Tree, n parse.Node, fname, base string, args []parse.Node) {
+	pa, ok := policyArgs[base]
+	if !ok || len(args) <= pa.idx {
+		return
+	}
+	if _, ok := args[pa.idx].(*parse.StringNode); !ok {
+		return
+	}
+	pos, _ := tree.ErrorContext(n)
+	lu := LiteralUse{fname, make([]string, 0, len(args)), pos}
+	for _, a := range args {
+		lu.Args = append(lu.Args, a.String())
+	}
+	switch base {
+	case "cmd":
+		r.Commands = append(r.Commands, lu)
+	case "env":
+		r.Env = append(r.Env, lu)
+	case "http":
+		r.URLs = append(r.URLs, lu)
+	default:
+		r.Files = append(r.Files, lu)
+	}
+}
@@ -0,0 +1,43 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	funcs := FnMap.Clone()
+	if err := funcs.Alias("sh", "cmd"); err != nil {
+		t.Fatal(err)
+	}
+	const none = `"files":[],"urls":[],"commands":[],"env":[]`
+	cases := []struct {
+		name, text string
+		want       string // the report as json
+		problems   int
+	}{
+		{"command", `{{cmd "ls" "-l"}}`, `{"functions":[{"name":"cmd","unsafe":true,"defined":true,"positions":["t:1:2"]}],"files":[],"urls":[],"commands":[{"function":"cmd","args":["\"ls\"","\"-l\""],"position":"t:1:2"}],"env":[],"fields":[]}`, 0},
+		{"alias", `{{sh "ls"}}`, `{"functions":[{"name":"sh","unsafe":true,"defined":true,"positions":["t:1:2"]}],"files":[],"urls":[],"commands":[{"function":"sh","args":["\"ls\""],"position":"t:1:2"}],"env":[],"fields":[]}`, 0},
+		{"piped file", `{{"/etc/hosts" | textfile}}`, `{"functions":[{"name":"textfile","unsafe":true,"defined":true,"positions":["t:1:17"]}],"files":[{"function":"textfile","args":["\"/etc/hosts\""],"position":"t:1:17"}],"urls":[],"commands":[],"env":[],"fields":[]}`, 0},
+		{"url", `{{http "GET" "https://x" "" nil}}`, `{"functions":[{"name":"http","unsafe":true,"defined":true,"positions":["t:1:2"]}],"files":[],"urls":[{"function":"http","args":["\"GET\"","\"https://x\"","\"\"","nil"],"position":"t:1:2"}],"commands":[],"env":[],"fields":[]}`, 0},
+		{"env and dynamic path", `{{textfile .Path}}{{env "HOME"}}`, `{"functions":[{"name":"env","unsafe":true,"defined":true,"positions":["t:1:20"]},{"name":"textfile","unsafe":true,"defined":true,"positions":["t:1:2"]}],"files":[],"urls":[],"commands":[],"env":[{"function":"env","args":["\"HOME\""],"position":"t:1:20"}],"fields":[".Path"]}`, 0},
+		{"fields", `{{range .Items}}{{.Name}}{{end}}{{$x := .A}}{{$x.B}}`, `{"functions":[],` + none + `,"fields":[".A",".Items",".Name","x.B"]}`, 0},
+		{"undefined and repeated", `{{nope 1}}{{upper "a"}}{{upper "b"}}`, `{"functions":[{"name":"nope","unsafe":false,"defined":false,"positions":["t:1:2"]},{"name":"upper","unsafe":false,"defined":true,"positions":["t:1:12","t:1:25"]}],` + none + `,"fields":[]}`, 0},
+		{"parse error", `{{if}}`, `{"functions":[],` + none + `,"fields":[]}`, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, problems := funcs.Inspect(map[string]string{"t": c.text})
+			b, err := json.Marshal(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != c.want || len(problems) != c.problems {
+				t.Fatalf("expected %s and %d problem(s), got %s and %+v", c.want, c.problems, b, problems)
+			}
+		})
+	}
+}
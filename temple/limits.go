@@ -0,0 +1,144 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/szampardi/msg"
+)
+
+// how long Execute waits for a canceled execution to return
+const cancelGrace = time.Second
+
+type (
+	// Limits bound a single template execution, zero values mean no limit
+	Limits struct {
+		Timeout   Duration       `json:"timeout" yaml:"timeout" toml:"timeout"`       // wall-clock time
+		MaxOutput int64          `json:"maxoutput" yaml:"maxoutput" toml:"maxoutput"` // bytes written
+		Calls     map[string]int `json:"calls" yaml:"calls" toml:"calls"`             // calls to each function
+	}
+	// Duration is a time.Duration that reads from strings like "1m30s"
+	Duration time.Duration
+	// LimitError tells which limit an execution ran into
+	LimitError struct {
+		Limit string
+		Value interface{}
+	}
+	limitWriter struct {
+		ctx     context.Context // writes fail once it's done
+		p       *Policy
+		w       io.Writer
+		max     int64
+		written int64
+		err     error
+		mu      sync.Mutex
+	}
+	callBudget struct {
+		limits map[string]int
+		calls  map[string]int
+		mu     sync.Mutex
+	}
+)
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	*d = Duration(v)
+	return err
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("limit exceeded: %s (%v)", e.Limit, e.Value)
+}
+
+// Execute runs exec, a template execution writing to w, within the policy limits. It returns as soon as ctx is done:
+// use the context from Context, the one functions were built with, so that they're aborted too.
+// text/template can't be interrupted, once ctx is done the execution stops at its next write or function call,
+// both fail. Until then it keeps running in the background: a function that ignores ctx runs until it returns,
+// and a range over large data whose body only uses builtins (eq, index, len...) without writing runs to its end.
+func (p *Policy) Execute(ctx context.Context, w io.Writer, exec func(io.Writer) error) error {
+	lw := &limitWriter{ctx: ctx, p: p, w: w}
+	if p != nil {
+		lw.max = p.Limits.MaxOutput
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- exec(lw)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		err := p.contextError(ctx)
+		lw.fail(err) // nothing more reaches w
+		select {
+		case <-done: // running functions were canceled too, give them the time to clean up (kill commands)
+		case <-time.After(cancelGrace):
+			log.Warningf("template execution still running %s after it was stopped (%s), it ends at its next write or function call", cancelGrace, err)
+		}
+		return err
+	}
+}
+
+func (lw *limitWriter) Write(b []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if lw.err == nil && lw.ctx != nil && lw.ctx.Err() != nil {
+		lw.err = lw.p.contextError(lw.ctx)
+	}
+	if lw.err != nil {
+		return 0, lw.err
+	}
+	if lw.max > 0 && lw.written+int64(len(b)) > lw.max {
+		n, _ := lw.w.Write(b[:lw.max-lw.written])
+		lw.written += int64(n)
+		lw.err = &LimitError{"maxoutput", fmt.Sprintf("%d bytes", lw.max)}
+		return n, lw.err
+	}
+	n, err := lw.w.Write(b)
+	lw.written += int64(n)
+	return n, err
+}
+
+func (lw *limitWriter) fail(err error) {
+	lw.mu.Lock()
+	lw.err = err
+	lw.mu.Unlock()
+}
+
+// budget counts calls to the functions of a single func map
+func (p *Policy) budget() *callBudget {
+	if p == nil || len(p.Limits.Calls) < 1 {
+		return nil
+	}
+	return &callBudget{limits: p.Limits.Calls, calls: map[string]int{}}
+}
+
+func (b *callBudget) wrap(name string, f interface{}) interface{} {
+	if b == nil {
+		return f
+	}
+	max, ok := b.limits[name]
+	if !ok {
+		return f
+	}
+	return intercept(f, func(args []reflect.Value) error {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.calls[name] >= max {
+			return &LimitError{"calls to " + name, max}
+		}
+		b.calls[name]++
+		return nil
+	})
+}
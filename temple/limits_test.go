@@ -0,0 +1,54 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimedOutExecutionStops(t *testing.T) {
+	var calls int64
+	slow := func() {
+		atomic.AddInt64(&calls, 1)
+		time.Sleep(time.Millisecond)
+	}
+	funcs := FnMap.Clone()
+	if err := funcs.Register("tick", Function{Fn: func() string { slow(); return "" }}); err != nil {
+		t.Fatal(err)
+	}
+	items := make([]int, 100000)
+	cases := map[string]struct {
+		text string
+		w    io.Writer
+	}{
+		"calls":  {`{{range .}}{{tick}}{{end}}`, ioutil.Discard},
+		"writes": {`{{range .}}x{{end}}`, writerFunc(func(b []byte) (int, error) { slow(); return len(b), nil })},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			atomic.StoreInt64(&calls, 0)
+			e := NewEngine(WithFunctions(funcs), WithLimits(Limits{Timeout: Duration(20 * time.Millisecond)}))
+			err := e.Render(context.Background(), []Template{{name, c.text}}, items, c.w)
+			var le *LimitError
+			if !errors.As(err, &le) || le.Limit != "timeout" {
+				t.Fatalf("expected a timeout, got %v", err)
+			}
+			stopped := atomic.LoadInt64(&calls)
+			time.Sleep(50 * time.Millisecond)
+			if n := atomic.LoadInt64(&calls); n > stopped+1 {
+				t.Fatalf("the execution went on after the timeout: %d calls, then %d", stopped, n)
+			}
+		})
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) { return f(b) }
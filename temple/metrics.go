@@ -0,0 +1,291 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/szampardi/msg"
+)
+
+// upper bounds in seconds of the duration histogram buckets
+var metricsBuckets = []float64{.0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// kinds of render errors
+const (
+	ErrorKindParse     = "parse"     // the templates don't parse
+	ErrorKindLimit     = "limit"     // a policy limit other than the timeout was exceeded
+	ErrorKindCanceled  = "canceled"  // the client went away
+	ErrorKindTimeout   = "timeout"   // the policy timeout or the request context deadline passed
+	ErrorKindExecution = "execution" // anything else, like a function failing
+)
+
+type (
+	// Metrics counts what the render server does, Trace is the Tracer feeding it, and it's served
+	// in the Prometheus text format by MetricsServer
+	Metrics struct {
+		renders   map[bool]uint64 // by success
+		durations histogram
+		errors    map[string]uint64 // by kind
+		functions map[string]*functionMetrics
+		requests  map[[2]string]uint64 // by handler and status code
+		inFlight  int64
+		ready     int32
+		mu        sync.Mutex
+	}
+	functionMetrics struct {
+		errors    uint64
+		durations histogram
+	}
+	histogram struct {
+		counts []uint64 // per bucket, not cumulative, the last one is +Inf
+		sum    float64
+		count  uint64
+	}
+	// statusRecorder keeps the status code of a response
+	statusRecorder struct {
+		http.ResponseWriter
+		status int
+	}
+	metricsKey struct{}
+)
+
+// NewMetrics returns empty metrics, not ready until SetReady
+func NewMetrics() *Metrics {
+	return &Metrics{
+		renders:   map[bool]uint64{},
+		errors:    map[string]uint64{},
+		functions: map[string]*functionMetrics{},
+		requests:  map[[2]string]uint64{},
+	}
+}
+
+// Trace counts c, a function call or a whole execution
+func (m *Metrics) Trace(c *Call) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c.Function == "" {
+		m.renders[c.Err == nil]++
+		m.durations.observe(c.Duration)
+		if c.Err != nil {
+			m.errors[errorKind(c.Err)]++
+		}
+		return
+	}
+	f, ok := m.functions[c.Function]
+	if !ok {
+		f = &functionMetrics{}
+		m.functions[c.Function] = f
+	}
+	f.durations.observe(c.Duration)
+	if c.Err != nil {
+		f.errors++
+	}
+}
+
+// parseError counts a render request whose templates don't parse, as a failed render
+func (m *Metrics) parseError() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.renders[false]++
+	m.errors[ErrorKindParse]++
+	m.mu.Unlock()
+}
+
+// SetReady tells whether the server is ready to handle requests, for /readyz
+func (m *Metrics) SetReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&m.ready, v)
+}
+
+// Instrument counts the requests to next, by status code, and those in progress
+func (m *Metrics) Instrument(handler string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&m.inFlight, 1)
+		defer atomic.AddInt64(&m.inFlight, -1)
+		sr := &statusRecorder{ResponseWriter: w}
+		next(sr, r.WithContext(context.WithValue(r.Context(), metricsKey{}, m)))
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		m.mu.Lock()
+		m.requests[[2]string{handler, strconv.Itoa(sr.status)}]++
+		m.mu.Unlock()
+	}
+}
+
+// MetricsServer serves m in the Prometheus text exposition format
+func MetricsServer(m *Metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := m.WriteText(w); err != nil {
+			log.Errorf("error sending response to request ( %s %s ) from %s: %s", r.Method, r.URL, r.RemoteAddr, err)
+		}
+	}
+}
+
+// HealthServer answers 200 for as long as the server is up
+func HealthServer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, http.StatusOK, jresp{Status: http.StatusOK, Results: "ok"})
+	}
+}
+
+// ReadyServer answers 200 when m is ready and all checks pass, 503 with the failures otherwise
+func ReadyServer(m *Metrics, checks map[string]func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var failed []string
+		if atomic.LoadInt32(&m.ready) != 1 {
+			failed = append(failed, "not ready")
+		}
+		for name, check := range checks {
+			if err := check(); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %s", name, err))
+			}
+		}
+		if len(failed) > 0 {
+			sort.Strings(failed)
+			log.Warningf("request ( %s %s ) from %s: not ready: %s", r.Method, r.URL, r.RemoteAddr, strings.Join(failed, "; "))
+			writeJSON(w, r, http.StatusServiceUnavailable, jresp{Status: http.StatusServiceUnavailable, Error: strings.Join(failed, "; ")})
+			return
+		}
+		writeJSON(w, r, http.StatusOK, jresp{Status: http.StatusOK, Results: "ready"})
+	}
+}
+
+// WriteText writes the metrics in the Prometheus text exposition format
+func (m *Metrics) WriteText(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := new(strings.Builder)
+	metricHeader(b, "xprint_renders_total", "counter", "Template executions, by outcome.")
+	fmt.Fprintf(b, "xprint_renders_total{outcome=\"success\"} %d\n", m.renders[true])
+	fmt.Fprintf(b, "xprint_renders_total{outcome=\"error\"} %d\n", m.renders[false])
+	metricHeader(b, "xprint_render_duration_seconds", "histogram", "Duration of template executions.")
+	m.durations.write(b, "xprint_render_duration_seconds", "")
+	metricHeader(b, "xprint_render_errors_total", "counter", "Failed renders, by kind of error.")
+	for _, kind := range []string{ErrorKindParse, ErrorKindLimit, ErrorKindCanceled, ErrorKindTimeout, ErrorKindExecution} {
+		fmt.Fprintf(b, "xprint_render_errors_total{kind=%q} %d\n", kind, m.errors[kind])
+	}
+	names := make([]string, 0, len(m.functions))
+	for name := range m.functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metricHeader(b, "xprint_function_calls_total", "counter", "Template function calls.")
+	for _, name := range names {
+		fmt.Fprintf(b, "xprint_function_calls_total{function=%q} %d\n", name, m.functions[name].durations.count)
+	}
+	metricHeader(b, "xprint_function_errors_total", "counter", "Template function calls that returned an error.")
+	for _, name := range names {
+		fmt.Fprintf(b, "xprint_function_errors_total{function=%q} %d\n", name, m.functions[name].errors)
+	}
+	metricHeader(b, "xprint_function_duration_seconds", "histogram", "Duration of template function calls.")
+	for _, name := range names {
+		m.functions[name].durations.write(b, "xprint_function_duration_seconds", fmt.Sprintf("function=%q", name))
+	}
+	keys := make([][2]string, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	metricHeader(b, "xprint_http_requests_total", "counter", "HTTP requests, by handler and status code.")
+	for _, k := range keys {
+		fmt.Fprintf(b, "xprint_http_requests_total{handler=%q,code=%q} %d\n", k[0], k[1], m.requests[k])
+	}
+	metricHeader(b, "xprint_http_requests_in_flight", "gauge", "HTTP requests being handled.")
+	fmt.Fprintf(b, "xprint_http_requests_in_flight %d\n", atomic.LoadInt64(&m.inFlight))
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func metricHeader(b *strings.Builder, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(metricsBuckets)+1)
+	}
+	s := d.Seconds()
+	h.counts[sort.SearchFloat64s(metricsBuckets, s)]++
+	h.sum += s
+	h.count++
+}
+
+// write writes the cumulative buckets, the sum and the count of h, labels go before le
+func (h *histogram) write(b *strings.Builder, name, labels string) {
+	if labels != "" {
+		labels += ","
+	}
+	var cumulative uint64
+	for i, le := range metricsBuckets {
+		if h.counts != nil {
+			cumulative += h.counts[i]
+		}
+		fmt.Fprintf(b, "%s_bucket{%sle=%q} %d\n", name, labels, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(b, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+	if labels != "" {
+		labels = "{" + strings.TrimSuffix(labels, ",") + "}"
+	}
+	fmt.Fprintf(b, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(b, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// errorKind tells what kind of error made a render fail
+func errorKind(err error) string {
+	var le *LimitError
+	switch {
+	case errors.As(err, &le) && le.Limit == "timeout":
+		return ErrorKindTimeout
+	case errors.As(err, &le):
+		return ErrorKindLimit
+	case errors.Is(err, context.Canceled):
+		return ErrorKindCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorKindTimeout
+	}
+	return ErrorKindExecution
+}
+
+// requestMetrics are the metrics r is counted in, nil if there are none
+func requestMetrics(r *http.Request) *Metrics {
+	m, _ := r.Context().Value(metricsKey{}).(*Metrics)
+	return m
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
@@ -0,0 +1,38 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsErrorKinds(t *testing.T) {
+	funcs := FnMap.Clone()
+	if err := funcs.Register("slow", Function{Fn: func() string { time.Sleep(50 * time.Millisecond); return "" }}); err != nil {
+		t.Fatal(err)
+	}
+	m := NewMetrics()
+	e := NewEngine(WithFunctions(funcs), WithTracer(m.Trace), WithLimits(Limits{Timeout: Duration(10 * time.Millisecond)}))
+	srv := m.Instrument("render", RenderServer(e))
+	for _, body := range []string{`{"template": "{{if}}"}`, `{"template": "{{slow}}{{slow}}"}`} {
+		srv(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/render", strings.NewReader(body)))
+	}
+	b := new(strings.Builder)
+	if err := m.WriteText(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`xprint_renders_total{outcome="error"} 2`,
+		`xprint_render_errors_total{kind="parse"} 1`,
+		`xprint_render_errors_total{kind="timeout"} 1`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("expected %s in:\n%s", line, b)
+		}
+	}
+}
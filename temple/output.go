@@ -0,0 +1,115 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	WriteAppend   = "append"
+	WriteTruncate = "truncate"
+	WriteAtomic   = "atomic" // write to a temporary file, then rename it over the destination
+)
+
+type WriteOptions struct {
+	Mode  string      // WriteAppend (default), WriteTruncate or WriteAtomic
+	Perm  os.FileMode // permissions of the file, 0 keeps the existing file's or uses 0600 for new ones
+	Mkdir bool        // create missing parent directories
+}
+
+// ParseWriteOptions reads options as used by the writefile function: a write mode, "mkdir" or an octal permission
+func ParseWriteOptions(opts ...string) (WriteOptions, error) {
+	var o WriteOptions
+	for _, opt := range opts {
+		switch opt {
+		case WriteAppend, WriteTruncate, WriteAtomic:
+			o.Mode = opt
+		case "mkdir":
+			o.Mkdir = true
+		default:
+			perm, err := strconv.ParseUint(opt, 8, 32)
+			if err != nil {
+				return o, fmt.Errorf("invalid write option %q, use %s, %s, %s, mkdir or an octal file mode", opt, WriteAppend, WriteTruncate, WriteAtomic)
+			}
+			o.Perm = os.FileMode(perm)
+		}
+	}
+	return o, nil
+}
+
+// WriteFile writes the content of r to fpath as specified by o
+func WriteFile(fpath string, r io.Reader, o WriteOptions) error {
+	if o.Mkdir {
+		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			return err
+		}
+	}
+	perm := o.Perm
+	existing, err := os.Stat(fpath)
+	switch {
+	case err == nil && perm == 0:
+		perm = existing.Mode().Perm()
+	case err != nil && !os.IsNotExist(err):
+		return err
+	case perm == 0:
+		perm = 0600
+	}
+	switch o.Mode {
+	case "", WriteAppend:
+		return writeTo(fpath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, perm, o.Perm != 0, r)
+	case WriteTruncate:
+		return writeTo(fpath, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, perm, o.Perm != 0, r)
+	case WriteAtomic:
+		return replaceFile(fpath, perm, existing, r)
+	}
+	return fmt.Errorf("unknown write mode %q", o.Mode)
+}
+
+func writeTo(fpath string, flag int, perm os.FileMode, chmod bool, r io.Reader) error {
+	f, err := os.OpenFile(fpath, flag, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err == nil && chmod {
+		err = f.Chmod(perm)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replaceFile atomically replaces fpath with the content of r, keeping the owner of the existing file (if any)
+func replaceFile(fpath string, perm os.FileMode, existing os.FileInfo, r io.Reader) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fpath), "."+filepath.Base(fpath)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = io.Copy(tmp, r); err == nil {
+		if err = tmp.Chmod(perm); err == nil {
+			if existing != nil {
+				err = chownLike(tmp, existing)
+			}
+			if err == nil {
+				err = tmp.Sync()
+			}
+		}
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fpath)
+}
@@ -0,0 +1,65 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		name     string
+		existing string // content of the file before, none if empty
+		opts     WriteOptions
+		want     string
+		perm     os.FileMode
+	}{
+		{"append new", "", WriteOptions{}, "new", 0600},
+		{"append", "old ", WriteOptions{Mode: WriteAppend}, "old new", 0640},
+		{"append perm", "old ", WriteOptions{Mode: WriteAppend, Perm: 0604}, "old new", 0604},
+		{"truncate", "old ", WriteOptions{Mode: WriteTruncate}, "new", 0640},
+		{"truncate perm", "old ", WriteOptions{Mode: WriteTruncate, Perm: 0604}, "new", 0604},
+		{"atomic", "old ", WriteOptions{Mode: WriteAtomic}, "new", 0640},
+		{"atomic perm", "old ", WriteOptions{Mode: WriteAtomic, Perm: 0604}, "new", 0604},
+		{"atomic new", "", WriteOptions{Mode: WriteAtomic, Perm: 0644}, "new", 0644},
+		{"mkdir", "", WriteOptions{Mode: WriteTruncate, Mkdir: true}, "new", 0600},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fpath := filepath.Join(dir, strings.ReplaceAll(c.name, " ", "-"), "out")
+			if c.existing != "" || !c.opts.Mkdir {
+				if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if c.existing != "" {
+				if err := ioutil.WriteFile(fpath, []byte(c.existing), 0640); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := WriteFile(fpath, strings.NewReader("new"), c.opts); err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadFile(fpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(fpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != c.want || info.Mode().Perm() != c.perm {
+				t.Fatalf("expected %q %s, got %q %s", c.want, c.perm, b, info.Mode().Perm())
+			}
+			if files, _ := ioutil.ReadDir(filepath.Dir(fpath)); len(files) != 1 {
+				t.Fatalf("expected no temporary file left, got %d files", len(files))
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package temple
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestWriteFileKeepsOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of a file needs root")
+	}
+	const uid, gid = 4321, 4322
+	fpath := filepath.Join(t.TempDir(), "out")
+	if err := ioutil.WriteFile(fpath, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(fpath, uid, gid); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fpath, strings.NewReader("new"), WriteOptions{Mode: WriteAtomic}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := info.Sys().(*syscall.Stat_t); st.Uid != uid || st.Gid != gid {
+		t.Fatalf("expected owner %d:%d, got %d:%d", uid, gid, st.Uid, st.Gid)
+	}
+}
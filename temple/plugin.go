@@ -0,0 +1,187 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PluginPrefix starts the name of the executables LoadPlugins picks up
+const PluginPrefix = "xprint-fn-"
+
+// how long a plugin has to print its manifest
+var pluginManifestTimeout = 5 * time.Second
+
+type (
+	// pluginManifest is what a plugin prints when run with --manifest
+	pluginManifest struct {
+		Functions []pluginFunction `json:"functions"`
+	}
+	pluginFunction struct {
+		Name        string     `json:"name"`
+		Description string     `json:"description"`
+		Params      []Param    `json:"params"`
+		Variadic    bool       `json:"variadic"` // the last param takes any number of arguments
+		Returns     string     `json:"returns"`
+		Examples    []string   `json:"examples"`
+		Categories  []string   `json:"categories"`
+		Unsafe      *bool      `json:"unsafe"` // plugins are unsafe unless they say otherwise
+		Redact      *Redaction `json:"redact"`
+	}
+	// a call is written to the plugin stdin, it answers on stdout
+	pluginRequest struct {
+		Function string        `json:"function"`
+		Args     []interface{} `json:"args"`
+	}
+	pluginResponse struct {
+		Result interface{} `json:"result"`
+		Error  string      `json:"error"`
+	}
+)
+
+// LoadPlugins finds the executables named xprint-fn-* in dirs and returns the functions they provide.
+// Each is run with --manifest to list its functions, then once per call: the call is written as JSON
+// ({"function": NAME, "args": [...]}) to its stdin, and it answers on stdout ({"result": ..., "error": "..."}).
+func LoadPlugins(dirs ...string) (Functions, error) {
+	out := Functions{}
+	for _, dir := range dirs {
+		matches, err := filepath.Glob(filepath.Join(dir, PluginPrefix+"*"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		for _, prog := range matches {
+			if info, err := os.Stat(prog); err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+				continue
+			}
+			fns, err := loadPlugin(prog)
+			if err != nil {
+				return nil, fmt.Errorf("plugin %s: %w", prog, err)
+			}
+			for name, f := range fns {
+				if err = out.Register(name, f); err != nil {
+					return nil, fmt.Errorf("plugin %s: %w", prog, err)
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+func loadPlugin(prog string) (Functions, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginManifestTimeout)
+	defer cancel()
+	stderr := new(bytes.Buffer)
+	c := exec.CommandContext(ctx, prog, "--manifest")
+	c.Stderr = stderr
+	b, err := c.Output()
+	if err != nil {
+		return nil, pluginError(err, stderr)
+	}
+	var m pluginManifest
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+	out := Functions{}
+	for _, pf := range m.Functions {
+		f := Function{
+			Fn:          pluginFn(prog, pf),
+			Description: pf.Description,
+			Unsafe:      pf.Unsafe == nil || *pf.Unsafe,
+			Params:      pf.Params,
+			Returns:     pf.Returns,
+			Examples:    pf.Examples,
+			Categories:  pf.Categories,
+			Redact:      pf.Redact,
+		}
+		if f.Description == "" {
+			f.Description = "provided by " + filepath.Base(prog)
+		}
+		if err = out.Register(pf.Name, f); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// pluginFn builds a function taking as many arguments as pf has params, calling prog
+func pluginFn(prog string, pf pluginFunction) interface{} {
+	anyType := reflect.TypeOf((*interface{})(nil)).Elem()
+	in := []reflect.Type{contextType}
+	for i := range pf.Params {
+		if pf.Variadic && i == len(pf.Params)-1 {
+			in = append(in, reflect.SliceOf(anyType))
+			break
+		}
+		in = append(in, anyType)
+	}
+	t := reflect.FuncOf(in, []reflect.Type{anyType, errorType}, pf.Variadic && len(pf.Params) > 0)
+	return reflect.MakeFunc(t, func(args []reflect.Value) []reflect.Value {
+		ctx := args[0].Interface().(context.Context)
+		callArgs := []interface{}{} // sent as [] and not null when there are none
+		for i, a := range args[1:] {
+			if t.IsVariadic() && i == len(args)-2 {
+				for j := 0; j < a.Len(); j++ {
+					callArgs = append(callArgs, a.Index(j).Interface())
+				}
+				break
+			}
+			callArgs = append(callArgs, a.Interface())
+		}
+		out, err := callPlugin(ctx, prog, pf, callArgs)
+		result := reflect.New(anyType).Elem()
+		if out != nil {
+			result.Set(reflect.ValueOf(out))
+		}
+		if err != nil {
+			return errorResult(t, err)
+		}
+		return []reflect.Value{result, reflect.Zero(errorType)}
+	}).Interface()
+}
+
+func callPlugin(ctx context.Context, prog string, pf pluginFunction, args []interface{}) (out interface{}, err error) {
+	defer func() {
+		tracked, output := Function{Params: pf.Params, Redact: pf.Redact}.redact(args, out)
+		trackUsage(pf.Name, true, output, err, tracked...)
+	}()
+	req, err := json.Marshal(pluginRequest{pf.Name, args})
+	if err != nil {
+		return nil, err
+	}
+	stderr := new(bytes.Buffer)
+	c := exec.CommandContext(ctx, prog)
+	c.Stdin = bytes.NewReader(req)
+	c.Stderr = stderr
+	b, err := c.Output()
+	if err != nil {
+		return nil, pluginError(err, stderr)
+	}
+	var resp pluginResponse
+	if err = json.Unmarshal(b, &resp); err != nil {
+		return nil, fmt.Errorf("%s: reading response: %w", filepath.Base(prog), err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%s", resp.Error)
+	}
+	return resp.Result, nil
+}
+
+// pluginError adds what the plugin wrote on stderr to err
+func pluginError(err error, stderr *bytes.Buffer) error {
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("%w: %s", err, msg)
+	}
+	return err
+}
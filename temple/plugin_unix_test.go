@@ -0,0 +1,93 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package temple
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPlugin answers echo with the request it got, fail with an error and crash by exiting
+const testPlugin = `#!/bin/sh
+if [ "$1" = "--manifest" ]; then
+	echo '{"functions": [
+		{"name": "echo", "params": [{"name": "a"}, {"name": "b"}], "unsafe": false},
+		{"name": "concat", "params": [{"name": "parts"}], "variadic": true, "unsafe": false},
+		{"name": "fail", "unsafe": false},
+		{"name": "crash", "unsafe": false},
+		{"name": "risky", "description": "unsafe by default"}
+	]}'
+	exit 0
+fi
+req=$(cat)
+case "$req" in
+*'"fail"'*) echo '{"error": "failed on purpose"}' ;;
+*'"crash"'*) echo "crashed" >&2; exit 3 ;;
+*) echo "{\"result\": $req}" ;;
+esac
+`
+
+func TestPlugins(t *testing.T) {
+	dir := t.TempDir()
+	files := []struct {
+		name string
+		mode os.FileMode
+	}{
+		{PluginPrefix + "test", 0755},
+		{PluginPrefix + "notexec", 0644}, // not executable, skipped
+		{"other", 0755},                  // not a plugin, skipped
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f.name), []byte(testPlugin), f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plugins, err := LoadPlugins(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(plugins.Names(), " "); got != "concat crash echo fail risky" {
+		t.Fatalf("unexpected plugin functions %s", got)
+	}
+	if d := plugins["echo"].Description; d != "provided by "+PluginPrefix+"test" {
+		t.Fatalf("unexpected default description %q", d)
+	}
+	funcs := FnMap.Clone()
+	for name, f := range plugins {
+		if err := funcs.Register(name, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := NewEngine(WithFunctions(funcs))
+	cases := []struct {
+		name, text string
+		want, err  string
+	}{
+		{"args", `{{$r := echo "x" 1}}{{$r.function}} {{$r.args}}`, "echo [x 1]", ""},
+		{"variadic", `{{(concat "a" "b" "c").args}}`, "[a b c]", ""},
+		{"variadic empty", `{{(concat).args}}`, "[]", ""},
+		{"error", `{{fail}}`, "", "failed on purpose"},
+		{"crash", `{{crash}}`, "", "crashed"},
+		{"unsafe by default", `{{risky}}`, "", `function "risky" not defined`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := new(strings.Builder)
+			err := e.Render(context.Background(), []Template{{c.name, c.text}}, nil, b)
+			if (c.err == "" && err != nil) || (c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err))) {
+				t.Fatalf("expected error %q, got %v", c.err, err)
+			}
+			if c.err == "" && b.String() != c.want {
+				t.Fatalf("expected %q, got %q", c.want, b.String())
+			}
+		})
+	}
+}
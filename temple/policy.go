@@ -0,0 +1,301 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// Policy decides which template functions are available and what they may be called with.
+	// Empty constraint lists mean no constraint.
+	Policy struct {
+		Unsafe   bool     `json:"unsafe" yaml:"unsafe" toml:"unsafe"`       // allow all unsafe functions
+		Allow    []string `json:"allow" yaml:"allow" toml:"allow"`          // unsafe functions to allow
+		Deny     []string `json:"deny" yaml:"deny" toml:"deny"`             // functions to never allow, safe or not
+		Env      []string `json:"env" yaml:"env" toml:"env"`                // name patterns of environment variables "env" can read
+		Paths    []string `json:"paths" yaml:"paths" toml:"paths"`          // path prefixes file functions can access
+		Hosts    []string `json:"hosts" yaml:"hosts" toml:"hosts"`          // host patterns "http" can reach
+		Commands []string `json:"commands" yaml:"commands" toml:"commands"` // programs "cmd" can execute
+		Root     string   `json:"root" yaml:"root" toml:"root"`             // directory file functions are jailed to
+		ReadOnly bool     `json:"readonly" yaml:"readonly" toml:"readonly"` // deny file writes
+		Limits   Limits   `json:"limits" yaml:"limits" toml:"limits"`
+	}
+	policyKey struct{}
+	policyArg struct {
+		idx   int
+		check func(*Policy, string) (string, error) // returns the argument to call the function with
+	}
+)
+
+// as many redirects as http follows, like http.DefaultClient
+const maxRedirects = 10
+
+// arguments checked against the policy constraints, by function name
+var policyArgs = map[string]policyArg{
+	"cmd":       {0, (*Policy).checkCommand},
+	"env":       {0, (*Policy).checkEnv},
+	"http":      {1, (*Policy).checkURL},
+	"rawfile":   {0, (*Policy).checkReadPath},
+	"textfile":  {0, (*Policy).checkReadPath},
+	"writefile": {1, (*Policy).checkWritePath},
+}
+
+// LoadPolicy reads a policy from a JSON, YAML or TOML file
+func LoadPolicy(p string) (*Policy, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	out := &Policy{}
+	switch DetectDataFormat(p, b) {
+	case FormatJSON:
+		err = json.Unmarshal(b, out)
+	case FormatTOML:
+		err = toml.Unmarshal(b, out)
+	default:
+		err = yaml.Unmarshal(b, out)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return out, nil
+}
+
+// Allows reports whether function name can be used at all, a nil policy allows only safe functions.
+// Aliases are denied along with the function they stand for.
+func (p *Policy) Allows(name string, f Function) bool {
+	if p == nil {
+		return !f.Unsafe
+	}
+	if p.denies(name, f) {
+		return false
+	}
+	return !f.Unsafe || p.Unsafe || contains(p.Allow, name) || contains(p.Allow, f.base(name))
+}
+
+// denies reports whether the policy denies function name explicitly, or the function it's an alias of
+func (p *Policy) denies(name string, f Function) bool {
+	return p != nil && (contains(p.Deny, name) || contains(p.Deny, f.base(name)))
+}
+
+// base is the function name stands for when f is an alias, name otherwise: the policy checks apply to it
+func (f Function) base(name string) string {
+	if f.AliasOf != "" {
+		return f.AliasOf
+	}
+	return name
+}
+
+// guard wraps f so that its arguments are checked against the policy before each call, name is the base function name
+func (p *Policy) guard(name string, f interface{}) interface{} {
+	pa, ok := policyArgs[name]
+	if !ok || p == nil {
+		return f
+	}
+	return intercept(f, func(args []reflect.Value) error {
+		if pa.idx >= len(args) {
+			return nil
+		}
+		arg, err := pa.check(p, fmt.Sprint(args[pa.idx].Interface()))
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		args[pa.idx] = reflect.ValueOf(arg).Convert(args[pa.idx].Type())
+		return nil
+	})
+}
+
+// intercept wraps f so that before runs ahead of every call, it can change the arguments or fail the call
+func intercept(f interface{}, before func(args []reflect.Value) error) interface{} {
+	v := reflect.ValueOf(f)
+	return reflect.MakeFunc(v.Type(), func(args []reflect.Value) []reflect.Value {
+		if err := before(args); err != nil {
+			return errorResult(v.Type(), err)
+		}
+		return callFn(v, args)
+	}).Interface()
+}
+
+func (p *Policy) checkEnv(name string) (string, error) {
+	if len(p.Env) < 1 {
+		return name, nil
+	}
+	for _, pattern := range p.Env {
+		if ok, _ := path.Match(pattern, name); ok {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("environment variable %s not allowed by policy", name)
+}
+
+func (p *Policy) checkReadPath(fpath string) (string, error) {
+	return p.checkPath(fpath, false)
+}
+
+func (p *Policy) checkWritePath(fpath string) (string, error) {
+	return p.checkPath(fpath, true)
+}
+
+func (p *Policy) checkPath(fpath string, write bool) (string, error) {
+	fpath, err := p.resolve(fpath, write)
+	if err != nil || len(p.Paths) < 1 {
+		return fpath, err
+	}
+	real, err := evalSymlinks(fpath) // a symlink under an allowed prefix can point anywhere
+	if err != nil {
+		return "", err
+	}
+	for _, prefix := range p.Paths {
+		prefix, err := filepath.Abs(prefix)
+		if err != nil {
+			continue
+		}
+		if r, err := evalSymlinks(prefix); err == nil {
+			prefix = r
+		}
+		if within(prefix, real) {
+			return fpath, nil
+		}
+	}
+	return "", fmt.Errorf("path %s not allowed by policy", fpath)
+}
+
+// resolve returns the absolute path fpath refers to: with a policy root, relative paths are
+// taken from the root and paths leaving it (with .. or through symlinks) are rejected
+func (p *Policy) resolve(fpath string, write bool) (string, error) {
+	if p == nil {
+		return fpath, nil
+	}
+	if write && p.ReadOnly {
+		return "", fmt.Errorf("cannot write %s: read-only policy", fpath)
+	}
+	if p.Root == "" {
+		return filepath.Abs(fpath)
+	}
+	root, err := filepath.Abs(p.Root)
+	if err != nil {
+		return "", err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return "", err
+	}
+	full := filepath.Clean(fpath)
+	if !filepath.IsAbs(full) {
+		full = filepath.Join(root, full)
+	}
+	if !within(root, full) {
+		return "", fmt.Errorf("path %s is outside of %s", fpath, root)
+	}
+	real, err := evalSymlinks(full)
+	if err != nil {
+		return "", err
+	}
+	if !within(root, real) {
+		return "", fmt.Errorf("path %s resolves outside of %s", fpath, root)
+	}
+	return real, nil
+}
+
+// evalSymlinks is filepath.EvalSymlinks for paths that may not exist yet:
+// the longest existing parent is resolved and the rest appended to it
+func evalSymlinks(fpath string) (string, error) {
+	real, err := filepath.EvalSymlinks(fpath)
+	if err == nil || !os.IsNotExist(err) {
+		return real, err
+	}
+	parent := filepath.Dir(fpath)
+	if parent == fpath {
+		return fpath, nil
+	}
+	real, err = evalSymlinks(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(real, filepath.Base(fpath)), nil
+}
+
+func within(dir, fpath string) bool {
+	return fpath == dir || strings.HasPrefix(fpath, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+func (p *Policy) checkURL(rawurl string) (string, error) {
+	if len(p.Hosts) < 1 {
+		return rawurl, nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	for _, pattern := range p.Hosts {
+		if ok, _ := path.Match(pattern, u.Hostname()); ok {
+			return rawurl, nil
+		}
+	}
+	return "", fmt.Errorf("host %s not allowed by policy", u.Hostname())
+}
+
+// checkRedirect is an http.Client CheckRedirect checking each hop against the policy hosts,
+// so that an allowed host can't send requests elsewhere
+func (p *Policy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if p == nil {
+		return nil
+	}
+	_, err := p.checkURL(req.URL.String())
+	return err
+}
+
+func (p *Policy) checkCommand(prog string) (string, error) {
+	if len(p.Commands) < 1 || contains(p.Commands, prog) {
+		return prog, nil
+	}
+	return "", fmt.Errorf("command %s not allowed by policy", prog)
+}
+
+// callFn calls v, spreading the trailing slice for variadic functions as reflect.MakeFunc hands it over
+func callFn(v reflect.Value, args []reflect.Value) []reflect.Value {
+	if v.Type().IsVariadic() {
+		return v.CallSlice(args)
+	}
+	return v.Call(args)
+}
+
+// errorResult builds the return values of a function of type t failing with err,
+// functions that can't return an error panic, which text/template reports as an error
+func errorResult(t reflect.Type, err error) []reflect.Value {
+	n := t.NumOut()
+	if n < 1 || t.Out(n-1) != errorType {
+		panic(err)
+	}
+	out := make([]reflect.Value, n)
+	for i := 0; i < n-1; i++ {
+		out[i] = reflect.Zero(t.Out(i))
+	}
+	out[n-1] = reflect.ValueOf(&err).Elem()
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
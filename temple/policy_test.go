@@ -0,0 +1,159 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPolicyPathJail(t *testing.T) {
+	base := t.TempDir()
+	root, outside := filepath.Join(base, "root"), filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "sub"), outside, root + "other"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(root, "file"), filepath.Join(outside, "secret")} {
+		if err := os.WriteFile(f, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{"file-link": filepath.Join(root, "file"), "secret-link": filepath.Join(outside, "secret"), "dir-link": outside, "up-link": ".."}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skipf("can't create symlinks: %s", err)
+		}
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path  string
+		write bool
+		want  string // the resolved path relative to the root, or the error
+	}{
+		{"file", false, "file"},
+		{"sub/../file", false, "file"},
+		{"sub/new", true, "sub/new"},
+		{filepath.Join(root, "file"), false, "file"},
+		{"file-link", false, "file"},
+		{"..", false, "is outside of"},
+		{"../outside/secret", false, "is outside of"},
+		{"sub/../../outside/secret", true, "is outside of"},
+		{filepath.Join(outside, "secret"), false, "is outside of"},
+		{filepath.Join(root+"other", "file"), true, "is outside of"},
+		{"secret-link", false, "resolves outside of"},
+		{"dir-link/secret", false, "resolves outside of"},
+		{"dir-link/new", true, "resolves outside of"},
+		{"up-link/outside/secret", false, "resolves outside of"},
+	}
+	p := &Policy{Root: root}
+	for _, c := range cases {
+		got, err := p.resolve(c.path, c.write)
+		switch {
+		case strings.Contains(c.want, " "):
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("%s: expected an error containing %q, got %q, %v", c.path, c.want, got, err)
+			}
+		case err != nil:
+			t.Errorf("%s: %s", c.path, err)
+		case got != filepath.Join(realRoot, filepath.FromSlash(c.want)):
+			t.Errorf("%s: resolved to %s, expected %s in %s", c.path, got, c.want, realRoot)
+		}
+	}
+
+	ro := &Policy{Root: root, ReadOnly: true}
+	if _, err = ro.resolve("file", false); err != nil {
+		t.Errorf("read-only policy: reading: %s", err)
+	}
+	if _, err = ro.resolve("file", true); err == nil || !strings.Contains(err.Error(), "read-only policy") {
+		t.Errorf("read-only policy: expected writing to be denied, got %v", err)
+	}
+
+	e := NewEngine(WithPolicy(&Policy{Unsafe: true, Root: root}))
+	for _, text := range []string{`{{textfile "secret-link"}}`, `{{writefile "x" "dir-link/new"}}`} {
+		if err = e.Render(context.Background(), []Template{{"jail", text}}, nil, new(bytes.Buffer)); err == nil {
+			t.Errorf("%s: expected the path to be denied", text)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(outside, "new")); !os.IsNotExist(err) {
+		t.Errorf("a file was written outside of the root: %v", err)
+	}
+}
+
+func TestHTTPRedirectsFollowPolicy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/final" {
+			w.WriteHeader(http.StatusTeapot)
+			return
+		}
+		http.Redirect(w, r, "http://127.0.0.1:"+strings.TrimPrefix(r.Host, "localhost:")+"/final", http.StatusFound)
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	text := `{{(http "GET" "http://localhost:` + u.Port() + `/" nil nil).StatusCode}}`
+	render := func(hosts ...string) (string, error) {
+		e := NewEngine(WithPolicy(&Policy{Unsafe: true, Hosts: hosts}))
+		buf := new(bytes.Buffer)
+		err := e.Render(context.Background(), []Template{{"redirect", text}}, nil, buf)
+		return buf.String(), err
+	}
+	if _, err := render("localhost"); err == nil || !strings.Contains(err.Error(), "host 127.0.0.1 not allowed by policy") {
+		t.Fatalf("expected the redirect to 127.0.0.1 to be denied, got %v", err)
+	}
+	if out, err := render("localhost", "127.0.0.1"); err != nil || out != "418" {
+		t.Fatalf("expected the redirect to be followed, got %q, %v", out, err)
+	}
+}
+
+func TestPolicyPaths(t *testing.T) {
+	base := t.TempDir()
+	allowed, outside := filepath.Join(base, "allowed"), filepath.Join(base, "outside")
+	for _, dir := range []string{allowed, outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(allowed, "file"), filepath.Join(outside, "secret")} {
+		if err := os.WriteFile(f, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{"secret-link": filepath.Join(outside, "secret"), "dir-link": outside, "file-link": filepath.Join(allowed, "file")}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(allowed, link)); err != nil {
+			t.Skipf("can't create symlinks: %s", err)
+		}
+	}
+	p := &Policy{Paths: []string{allowed}}
+	cases := []struct {
+		path  string
+		write bool
+		err   string
+	}{
+		{"file", false, ""},
+		{"file-link", false, ""},
+		{"new", true, ""},
+		{"../outside/secret", false, "not allowed by policy"},
+		{"secret-link", false, "not allowed by policy"},
+		{"dir-link/secret", false, "not allowed by policy"},
+		{"dir-link/new", true, "not allowed by policy"},
+	}
+	for _, c := range cases {
+		_, err := p.checkPath(filepath.Join(allowed, c.path), c.write)
+		if (c.err == "" && err != nil) || (c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err))) {
+			t.Errorf("%s: expected error %q, got %v", c.path, c.err, err)
+		}
+	}
+}
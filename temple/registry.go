@@ -0,0 +1,193 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type functionsKey struct{}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Register adds function name, failing if there's already one by that name or if f can't be called from templates
+func (t Functions) Register(name string, f Function) error {
+	if _, ok := t[name]; ok {
+		return fmt.Errorf("function %s already registered", name)
+	}
+	if err := checkFunction(name, f); err != nil {
+		return err
+	}
+	f.Signature = signature(f.Fn)
+	f.AliasOf = ""
+	t[name] = f
+	return nil
+}
+
+// Override replaces the implementation of function name, the metadata f leaves empty is kept from the old one
+func (t Functions) Override(name string, f Function) error {
+	old, ok := t[name]
+	if !ok {
+		return fmt.Errorf("function %s not registered", name)
+	}
+	if f.Description == "" {
+		f.Description = old.Description
+	}
+	if f.Params == nil && reflect.TypeOf(f.Fn) == reflect.TypeOf(old.Fn) {
+		f.Params = old.Params
+	}
+	if f.Returns == "" {
+		f.Returns = old.Returns
+	}
+	if f.Examples == nil {
+		f.Examples = old.Examples
+	}
+	if f.Categories == nil {
+		f.Categories = old.Categories
+	}
+	if f.Redact == nil && checkRedaction(name, Function{Params: f.Params, Redact: old.Redact}) == nil {
+		f.Redact = old.Redact
+	}
+	if err := checkFunction(name, f); err != nil {
+		return err
+	}
+	f.Signature = signature(f.Fn)
+	f.AliasOf = old.AliasOf
+	t[name] = f
+	return nil
+}
+
+// Alias registers alias as another name for function name
+func (t Functions) Alias(alias, name string) error {
+	f, ok := t[name]
+	if !ok {
+		return fmt.Errorf("function %s not registered", name)
+	}
+	if f.AliasOf != "" {
+		name = f.AliasOf
+	}
+	if err := t.Register(alias, f); err != nil {
+		return err
+	}
+	f = t[alias]
+	f.AliasOf = name
+	t[alias] = f
+	return nil
+}
+
+// Remove deletes function name and its aliases
+func (t Functions) Remove(name string) error {
+	if _, ok := t[name]; !ok {
+		return fmt.Errorf("function %s not registered", name)
+	}
+	delete(t, name)
+	for alias, f := range t {
+		if f.AliasOf == name {
+			delete(t, alias)
+		}
+	}
+	return nil
+}
+
+// Names lists the functions in t, sorted
+func (t Functions) Names() []string {
+	out := make([]string, 0, len(t))
+	for name := range t {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// checkFunction makes sure text/template will accept f as function name
+func checkFunction(name string, f Function) error {
+	if !identifier.MatchString(name) {
+		return fmt.Errorf("invalid function name %q", name)
+	}
+	t := reflect.TypeOf(f.Fn)
+	if t == nil || t.Kind() != reflect.Func {
+		return fmt.Errorf("function %s: %T is not a function", name, f.Fn)
+	}
+	switch {
+	case t.NumOut() == 1:
+	case t.NumOut() == 2 && t.Out(1) == errorType:
+	default:
+		return fmt.Errorf("function %s: must return a value, or a value and an error", name)
+	}
+	if takesContext(t) {
+		t = withoutContext(t)
+	}
+	if len(f.Params) > 0 && len(f.Params) != t.NumIn() {
+		return fmt.Errorf("function %s: %d params documented for %d arguments", name, len(f.Params), t.NumIn())
+	}
+	return checkRedaction(name, f)
+}
+
+// Usage is how function name is called, with parameter names when they're documented
+func (f Function) Usage(name string) string {
+	t := reflect.TypeOf(f.Fn)
+	if takesContext(t) {
+		t = withoutContext(t)
+	}
+	args := make([]string, 0, t.NumIn())
+	for i := 0; i < t.NumIn(); i++ {
+		typ := typeName(t.In(i))
+		if t.IsVariadic() && i == t.NumIn()-1 {
+			typ = "..." + typeName(t.In(i).Elem())
+		}
+		if i < len(f.Params) {
+			typ = f.Params[i].Name + " " + typ
+		}
+		args = append(args, typ)
+	}
+	out := make([]string, 0, t.NumOut())
+	for i := 0; i < t.NumOut(); i++ {
+		out = append(out, typeName(t.Out(i)))
+	}
+	ret := strings.Join(out, ", ")
+	if len(out) > 1 {
+		ret = "(" + ret + ")"
+	}
+	return fmt.Sprintf("%s(%s) %s", name, strings.Join(args, ", "), ret)
+}
+
+// typeName is how t reads in Go source
+func typeName(t reflect.Type) string {
+	return strings.NewReplacer("interface {}", "interface{}", "uint8", "byte").Replace(t.String())
+}
+
+// HelpText documents the functions in t
+func (t Functions) HelpText() string {
+	b := new(strings.Builder)
+	for _, name := range t.Names() {
+		f := t[name]
+		fmt.Fprint(b, f.Usage(name))
+		if f.Unsafe {
+			fmt.Fprint(b, " [unsafe]")
+		}
+		fmt.Fprintf(b, "\n\t%s\n", f.Description)
+		if f.AliasOf != "" {
+			fmt.Fprintf(b, "\talias of %s\n", f.AliasOf)
+		}
+		for _, p := range f.Params {
+			if p.Doc != "" {
+				fmt.Fprintf(b, "\t%s: %s\n", p.Name, p.Doc)
+			}
+		}
+		if f.Returns != "" {
+			fmt.Fprintf(b, "\treturns %s\n", f.Returns)
+		}
+		for _, e := range f.Examples {
+			fmt.Fprintf(b, "\texample: %s\n", e)
+		}
+		if meta := helpMeta(f); meta != "" {
+			fmt.Fprintf(b, "\t%s\n", meta)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,55 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestAliasFollowsPolicy(t *testing.T) {
+	funcs := FnMap.Clone()
+	for alias, name := range map[string]string{"sh": "cmd", "getenv": "env", "fetch": "http", "save": "writefile"} {
+		if err := funcs.Alias(alias, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := t.TempDir()
+	cases := []struct {
+		name   string
+		policy *Policy
+		text   string
+		err    string
+	}{
+		{"denied", &Policy{Unsafe: true, Deny: []string{"cmd"}}, `{{sh "true"}}`, `"sh" not defined`},
+		{"not allowed", &Policy{Allow: []string{"env"}}, `{{sh "true"}}`, `"sh" not defined`},
+		{"commands", &Policy{Unsafe: true, Commands: []string{"true"}}, `{{(sh "echo" "x").Stdout}}`, "command echo not allowed by policy"},
+		{"env", &Policy{Unsafe: true, Env: []string{"XPRINT_TEST_*"}}, `{{getenv "HOME"}}`, "environment variable HOME not allowed by policy"},
+		{"hosts", &Policy{Unsafe: true, Hosts: []string{"example.com"}}, `{{fetch "GET" "http://127.0.0.1:1/" nil nil}}`, "host 127.0.0.1 not allowed by policy"},
+		{"root", &Policy{Unsafe: true, Root: root}, `{{save "x" "../escape"}}`, "is outside of"},
+		{"read-only", &Policy{Unsafe: true, Root: root, ReadOnly: true}, `{{save "x" "file"}}`, "read-only policy"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := NewEngine(WithFunctions(funcs), WithPolicy(c.policy))
+			err := e.Render(context.Background(), []Template{{"alias", c.text}}, nil, new(bytes.Buffer))
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("expected an error containing %q, got %v", c.err, err)
+			}
+		})
+	}
+}
+
+func TestAliasCheckedAsDenied(t *testing.T) {
+	funcs := FnMap.Clone()
+	if err := funcs.Alias("sh", "cmd"); err != nil {
+		t.Fatal(err)
+	}
+	problems := funcs.Check(&Policy{Unsafe: true, Deny: []string{"cmd"}}, map[string]string{"alias": `{{sh "true"}}`})
+	if len(problems) != 1 || problems[0].Kind != ProblemDeniedFunction {
+		t.Fatalf("expected sh to be reported as denied, got %+v", problems)
+	}
+}
@@ -0,0 +1,139 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Redacted is what a secret looks like in traces, logs and debug output
+const Redacted = "[REDACTED]"
+
+type (
+	// Secret holds a value that prints as [REDACTED], in templates too: reveal gets it back
+	Secret struct {
+		v interface{}
+	}
+	// Redaction tells which arguments and results of a function are sensitive,
+	// traces and logs show them as [REDACTED]
+	Redaction struct {
+		Params []string `json:"params,omitempty"` // names of the sensitive params
+		Output bool     `json:"output,omitempty"` // the result is sensitive
+		When   string   `json:"when,omitempty"`   // only when this param is true
+	}
+)
+
+// NewSecret wraps v, unless it's a Secret already
+func NewSecret(v interface{}) Secret {
+	if s, ok := v.(Secret); ok {
+		return s
+	}
+	return Secret{v}
+}
+
+// Value is the wrapped value
+func (s Secret) Value() interface{} {
+	return s.v
+}
+
+func (Secret) String() string { return Redacted }
+
+func (Secret) GoString() string { return Redacted }
+
+func (Secret) MarshalJSON() ([]byte, error) { return []byte(`"` + Redacted + `"`), nil }
+
+func (Secret) MarshalYAML() (interface{}, error) { return Redacted, nil }
+
+func secret(in interface{}) Secret {
+	return NewSecret(in)
+}
+
+func reveal(in interface{}) interface{} {
+	if s, ok := in.(Secret); ok {
+		return s.v
+	}
+	return in
+}
+
+// redact replaces the sensitive args and output of a call to f with secrets.
+// args are as the function is called from templates, the last param collects the variadic ones.
+func (f Function) redact(args []interface{}, out interface{}) ([]interface{}, interface{}) {
+	r := f.Redact
+	if r == nil || (len(r.Params) < 1 && !r.Output) {
+		return args, out
+	}
+	if r.When != "" && !truthy(paramArgs(f.Params, r.When, args)) {
+		return args, out
+	}
+	redacted := append([]interface{}{}, args...)
+	for _, name := range r.Params {
+		i := indexOfParam(f.Params, name)
+		for j := range paramArgs(f.Params, name, args) {
+			redacted[i+j] = NewSecret(args[i+j])
+		}
+	}
+	if r.Output && out != nil {
+		out = NewSecret(out)
+	}
+	return redacted, out
+}
+
+// paramArgs are the args of param name
+func paramArgs(params []Param, name string, args []interface{}) []interface{} {
+	i := indexOfParam(params, name)
+	switch {
+	case i < 0 || i >= len(args):
+		return nil
+	case i == len(params)-1:
+		return args[i:]
+	}
+	return args[i : i+1]
+}
+
+func indexOfParam(params []Param, name string) int {
+	for i, p := range params {
+		if p.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// truthy tells whether a flag argument is set, variadic ones come as a slice
+func truthy(values []interface{}) bool {
+	for _, v := range values {
+		rv := reflect.ValueOf(v)
+		switch {
+		case !rv.IsValid():
+		case rv.Kind() == reflect.Bool:
+			if rv.Bool() {
+				return true
+			}
+		case rv.Kind() == reflect.Slice:
+			for i := 0; i < rv.Len(); i++ {
+				if truthy([]interface{}{rv.Index(i).Interface()}) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func checkRedaction(name string, f Function) error {
+	if f.Redact == nil {
+		return nil
+	}
+	names := append([]string{}, f.Redact.Params...)
+	if f.Redact.When != "" {
+		names = append(names, f.Redact.When)
+	}
+	for _, p := range names {
+		if indexOfParam(f.Params, p) < 0 {
+			return fmt.Errorf("function %s: redaction of undocumented param %s", name, p)
+		}
+	}
+	return nil
+}
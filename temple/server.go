@@ -10,6 +10,8 @@ import (
 	"io"
 	"net/http"
 	"net/http/httputil"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -31,11 +33,12 @@ type (
 	}
 )
 
-func RenderServer(fnMap templeFnMap) http.HandlerFunc {
+// RenderServer renders the templates posted to it with e, canceling running functions if the client goes away
+func RenderServer(e *Engine) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Noticef("new request ( %s %s ) from %s", r.Method, r.URL, r.RemoteAddr)
 		if DebugHTTPRequests {
-			b, err := httputil.DumpRequest(r, true)
+			b, err := dumpRequest(r)
 			if err != nil {
 				log.Errorf("request ( %s %s ) from %s: error dumping request: %s", r.Method, r.URL, r.RemoteAddr, err)
 				http.Error(w, "", http.StatusInternalServerError)
@@ -68,7 +71,9 @@ func RenderServer(fnMap templeFnMap) http.HandlerFunc {
 					break
 				}
 				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					if !bodyTooLarge(w, r) {
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+					}
 					return
 				}
 				switch pname := part.FormName(); pname {
@@ -77,7 +82,9 @@ func RenderServer(fnMap templeFnMap) http.HandlerFunc {
 					_, err = io.Copy(buf, part)
 					if err != nil {
 						log.Errorf("request ( %s %s ) from %s: error reading part %s request.MultipartReader: %s", r.Method, r.URL, r.RemoteAddr, pname, err)
-						http.Error(w, err.Error(), http.StatusInternalServerError)
+						if !bodyTooLarge(w, r) {
+							http.Error(w, err.Error(), http.StatusInternalServerError)
+						}
 						return
 					}
 					post.Template = buf.String()
@@ -86,7 +93,9 @@ func RenderServer(fnMap templeFnMap) http.HandlerFunc {
 					_, err = io.Copy(buf, part)
 					if err != nil {
 						log.Errorf("request ( %s %s ) from %s: error reading part %s request.MultipartReader: %s", r.Method, r.URL, r.RemoteAddr, pname, err)
-						http.Error(w, err.Error(), http.StatusInternalServerError)
+						if !bodyTooLarge(w, r) {
+							http.Error(w, err.Error(), http.StatusInternalServerError)
+						}
 						return
 					}
 					d := buf.Bytes()
@@ -99,7 +108,9 @@ func RenderServer(fnMap templeFnMap) http.HandlerFunc {
 					_, err = io.Copy(buf, part)
 					if err != nil {
 						log.Errorf("request ( %s %s ) from %s: error reading part %s request.MultipartReader: %s", r.Method, r.URL, r.RemoteAddr, pname, err)
-						http.Error(w, err.Error(), http.StatusInternalServerError)
+						if !bodyTooLarge(w, r) {
+							http.Error(w, err.Error(), http.StatusInternalServerError)
+						}
 						return
 					}
 					if buf.Len() > 0 {
@@ -110,7 +121,9 @@ func RenderServer(fnMap templeFnMap) http.HandlerFunc {
 					_, err = io.Copy(buf, part)
 					if err != nil {
 						log.Errorf("request ( %s %s ) from %s: error reading part %s request.MultipartReader: %s", r.Method, r.URL, r.RemoteAddr, pname, err)
-						http.Error(w, err.Error(), http.StatusInternalServerError)
+						if !bodyTooLarge(w, r) {
+							http.Error(w, err.Error(), http.StatusInternalServerError)
+						}
 						return
 					}
 					post.Outfile = buf.String()
@@ -119,7 +132,9 @@ func RenderServer(fnMap templeFnMap) http.HandlerFunc {
 					_, err = io.Copy(buf, part)
 					if err != nil {
 						log.Errorf("request ( %s %s ) from %s: error reading part %s request.MultipartReader: %s", r.Method, r.URL, r.RemoteAddr, pname, err)
-						http.Error(w, err.Error(), http.StatusInternalServerError)
+						if !bodyTooLarge(w, r) {
+							http.Error(w, err.Error(), http.StatusInternalServerError)
+						}
 						return
 					}
 					post.ForceDL, err = strconv.ParseBool(buf.String())
@@ -132,6 +147,9 @@ func RenderServer(fnMap templeFnMap) http.HandlerFunc {
 			}
 		} else {
 			if err = json.NewDecoder(r.Body).Decode(&post); err != nil {
+				if bodyTooLarge(w, r) {
+					return
+				}
 				log.Warningf("error processing request ( %s %s ) from %s: json.Decode: %s", r.Method, r.URL, r.RemoteAddr, err)
 				w.WriteHeader(http.StatusBadRequest)
 				json.NewEncoder(w).Encode(jresp{
@@ -141,8 +159,25 @@ func RenderServer(fnMap templeFnMap) http.HandlerFunc {
 				return
 			}
 		}
-		tpl, _, err := fnMap.BuildTemplate(EnableUnsafeFunctions, "post", post.Template, post.Templates)
+		templates := []Template{}
+		if post.Template != "" {
+			templates = append(templates, Template{"post", post.Template})
+		}
+		names := make([]string, 0, len(post.Templates))
+		for name := range post.Templates {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			templates = append(templates, Template{path.Base(name), post.Templates[name]})
+		}
+		if err = requestLimits(r).checkTemplates(templates); err != nil {
+			tooLarge(w, r, err)
+			return
+		}
+		tpl, err := requestEngine(e, r).Parse(templates...)
 		if err != nil {
+			requestMetrics(r).parseError()
 			log.Errorf("request ( %s %s ) from %s: error building template.Template: %s", r.Method, r.URL, r.RemoteAddr, err)
 			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(jresp{
@@ -153,7 +188,8 @@ func RenderServer(fnMap templeFnMap) http.HandlerFunc {
 		}
 		buf := new(bytes.Buffer)
 		ctypeBuf := bytes.NewBuffer(make([]byte, 512))
-		if err := tpl.Execute(io.MultiWriter(buf, ctypeBuf), post.Data); err != nil {
+		err = tpl.Execute(r.Context(), post.Data, io.MultiWriter(buf, ctypeBuf))
+		if err != nil {
 			log.Warningf("error processing request ( %s %s ) from %s: tplog.Execute: %s", r.Method, r.URL, r.RemoteAddr, err)
 			w.WriteHeader(http.StatusInternalServerError)
 			json.NewEncoder(w).Encode(jresp{
@@ -168,7 +204,7 @@ func RenderServer(fnMap templeFnMap) http.HandlerFunc {
 		w.Header().Set("Expires", "0")
 		w.Header().Set("Content-Control", "private, no-transform, no-store, must-revalidate")
 		if (buf.Len() < (1 << 20)) && !post.ForceDL && multipart {
-			tpl, _, err := FnMap.BuildHTMLTemplate(false, "rendered", renderedPage, nil)
+			tpl, _, err := FnMap.BuildHTMLTemplate(r.Context(), nil, "rendered", renderedPage, nil)
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				log.Errorf("error building template for response to request ( %s %s ) from %s: %s", r.Method, r.URL, r.RemoteAddr, err)
@@ -204,7 +240,7 @@ func UIPage() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Noticef("new request ( %s %s ) from %s", r.Method, r.URL, r.RemoteAddr)
 		if DebugHTTPRequests {
-			b, _ := httputil.DumpRequest(r, true)
+			b, _ := dumpRequest(r)
 			log.Debugf("request ( %s %s ) from %s: %s", r.Method, r.URL, r.RemoteAddr, string(b))
 		}
 		if r.Method != http.MethodGet || r.URL.Path != "/" {
@@ -212,7 +248,7 @@ func UIPage() http.HandlerFunc {
 			bye(w, r)
 			return
 		}
-		tpl, _, err := FnMap.BuildHTMLTemplate(false, "ui", uiPage, nil)
+		tpl, _, err := FnMap.BuildHTMLTemplate(r.Context(), nil, "ui", uiPage, nil)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			log.Errorf("error building template for response to request ( %s %s ) from %s: %s", r.Method, r.URL, r.RemoteAddr, err)
@@ -345,6 +381,18 @@ code {
 </html>`
 )
 
+// dumpRequest is httputil.DumpRequest with the credentials redacted
+func dumpRequest(r *http.Request) ([]byte, error) {
+	x := *r
+	x.Header = r.Header.Clone()
+	if x.Header.Get("Authorization") != "" {
+		x.Header.Set("Authorization", Redacted)
+	}
+	b, err := httputil.DumpRequest(&x, true)
+	r.Body = x.Body // DumpRequest replaced it with a copy of what it read
+	return b, err
+}
+
 func bye(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "https://www.youtube.com/watch?v=dQw4w9WgXcQ?autoplay=1", http.StatusPermanentRedirect)
 }
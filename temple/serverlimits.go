@@ -0,0 +1,175 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	log "github.com/szampardi/msg"
+)
+
+// errBodyTooLarge is what reading a request body returns past ServerLimits.MaxBody
+var errBodyTooLarge = errors.New("request body too large")
+
+type (
+	// ServerLimits bounds what a client can ask of the render server, zero values mean no limit
+	ServerLimits struct {
+		MaxBody         int64 // bytes of a request body
+		MaxTemplates    int   // templates in a render request, and in the store
+		MaxTemplateSize int64 // bytes of a template
+		MaxPerClient    int   // requests of a client, by identity or address, handled at the same time
+		clients         map[string]int
+		mu              sync.Mutex
+	}
+	// limitedBody is a request body failing with errBodyTooLarge once more than left bytes are read
+	limitedBody struct {
+		io.ReadCloser
+		left     int64
+		exceeded bool
+	}
+	limitsKey struct{}
+)
+
+// Limit lets through to next the requests within l, with their body limited. A nil ServerLimits lets everything through.
+// Wrap it with Auth.Require so that clients are told apart by their identity.
+func (l *ServerLimits) Limit(next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l.MaxBody > 0 && r.ContentLength > l.MaxBody {
+			log.Warningf("rejected request ( %s %s ) from %s: body of %d bytes", r.Method, r.URL, r.RemoteAddr, r.ContentLength)
+			w.Header().Set("Connection", "close")
+			writeJSON(w, r, http.StatusRequestEntityTooLarge, jresp{Status: http.StatusRequestEntityTooLarge, Error: fmt.Sprintf("request body larger than %d bytes", l.MaxBody)})
+			return
+		}
+		client := clientKey(r)
+		if !l.acquire(client) {
+			log.Warningf("rejected request ( %s %s ) from %s: %s has %d requests in progress", r.Method, r.URL, r.RemoteAddr, client, l.MaxPerClient)
+			w.Header().Set("Retry-After", "1")
+			writeJSON(w, r, http.StatusTooManyRequests, jresp{Status: http.StatusTooManyRequests, Error: fmt.Sprintf("too many requests in progress, at most %d are allowed", l.MaxPerClient)})
+			return
+		}
+		defer l.release(client)
+		if l.MaxBody > 0 && r.Body != nil {
+			r.Body = &limitedBody{ReadCloser: r.Body, left: l.MaxBody}
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), limitsKey{}, l)))
+	}
+}
+
+func (l *ServerLimits) acquire(client string) bool {
+	if l.MaxPerClient < 1 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients == nil {
+		l.clients = map[string]int{}
+	}
+	if l.clients[client] >= l.MaxPerClient {
+		return false
+	}
+	l.clients[client]++
+	return true
+}
+
+func (l *ServerLimits) release(client string) {
+	if l.MaxPerClient < 1 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients[client]--; l.clients[client] < 1 {
+		delete(l.clients, client)
+	}
+}
+
+// checkTemplates tells whether templates are within l
+func (l *ServerLimits) checkTemplates(templates []Template) error {
+	if l == nil {
+		return nil
+	}
+	if l.MaxTemplates > 0 && len(templates) > l.MaxTemplates {
+		return fmt.Errorf("%d templates, at most %d are allowed", len(templates), l.MaxTemplates)
+	}
+	for _, t := range templates {
+		if err := l.checkTemplateSize(t.Name, len(t.Text)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *ServerLimits) checkTemplateSize(name string, size int) error {
+	if l != nil && l.MaxTemplateSize > 0 && int64(size) > l.MaxTemplateSize {
+		return fmt.Errorf("template %s is larger than %d bytes", name, l.MaxTemplateSize)
+	}
+	return nil
+}
+
+// requestLimits are the limits r is handled with, nil if there are none
+func requestLimits(r *http.Request) *ServerLimits {
+	l, _ := r.Context().Value(limitsKey{}).(*ServerLimits)
+	return l
+}
+
+// clientKey tells clients apart: by identity when they're authenticated, or by address
+func clientKey(r *http.Request) string {
+	if id, ok := RequestIdentity(r); ok {
+		return id.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, errBodyTooLarge
+	}
+	if b.left < 1 {
+		n, err := b.ReadCloser.Read(make([]byte, 1))
+		if n > 0 {
+			b.exceeded = true
+			return 0, errBodyTooLarge
+		}
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	return n, err
+}
+
+// bodyTooLarge sends a 413 and returns true if the body of r was cut by ServerLimits.MaxBody
+func bodyTooLarge(w http.ResponseWriter, r *http.Request) bool {
+	b, ok := r.Body.(*limitedBody)
+	if !ok || !b.exceeded {
+		return false
+	}
+	log.Warningf("rejected request ( %s %s ) from %s: body larger than %d bytes", r.Method, r.URL, r.RemoteAddr, requestLimits(r).MaxBody)
+	w.Header().Set("Connection", "close")
+	writeJSON(w, r, http.StatusRequestEntityTooLarge, jresp{Status: http.StatusRequestEntityTooLarge, Error: fmt.Sprintf("request body larger than %d bytes", requestLimits(r).MaxBody)})
+	return true
+}
+
+// tooLarge sends a 413 for err
+func tooLarge(w http.ResponseWriter, r *http.Request, err error) {
+	log.Warningf("rejected request ( %s %s ) from %s: %s", r.Method, r.URL, r.RemoteAddr, err)
+	writeJSON(w, r, http.StatusRequestEntityTooLarge, jresp{Status: http.StatusRequestEntityTooLarge, Error: err.Error()})
+}
@@ -0,0 +1,362 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/szampardi/msg"
+)
+
+var (
+	// errInvalidTemplate is the error of a template the store refuses, by name or because it doesn't parse
+	errInvalidTemplate = errors.New("invalid template")
+	// errStoreFull is the error of a new template when the store holds as many as it can
+	errStoreFull = errors.New("template store full")
+	// errNotAllowed is the error of a template that calls functions the engine rendering it doesn't allow
+	errNotAllowed = errors.New("not allowed")
+)
+
+// TemplateStore holds named templates for the render server. With a directory
+// they're loaded from it, and changes are written back to it.
+type TemplateStore struct {
+	e         *Engine // the templates must parse with it, together
+	dir       string
+	templates map[string]string
+	parsed    *Parsed // all the templates, until they change
+	mu        sync.RWMutex
+}
+
+// NewTemplateStore loads the files in dir (recursively, named by their slash separated path in it), dir can be empty.
+// Files that don't parse with e are left out, with an error logged.
+func NewTemplateStore(e *Engine, dir string) (*TemplateStore, error) {
+	s := &TemplateStore{e: e, dir: dir, templates: map[string]string{}}
+	if dir == "" {
+		return s, nil
+	}
+	err := filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && fpath != dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			return err
+		}
+		text, err := fload(fpath)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if _, err = e.Parse(Template{name, text}); err != nil {
+			log.Errorf("not serving template %s: %s", name, err)
+			return nil
+		}
+		s.templates[name] = text
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(s.templates) > 0 {
+		if _, err = e.Parse(sortedTemplates(s.templates)...); err != nil {
+			return nil, fmt.Errorf("templates in %s don't parse together: %s", dir, err)
+		}
+	}
+	return s, nil
+}
+
+// Names lists the stored templates
+func (s *TemplateStore) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]string, 0, len(s.templates))
+	for name := range s.templates {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Get returns the text of template name
+func (s *TemplateStore) Get(name string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	text, ok := s.templates[name]
+	return text, ok
+}
+
+// Put adds or replaces template name, telling whether it's new. It must parse along with the other templates,
+// and with max > 0 a new one is refused once the store holds max.
+func (s *TemplateStore) Put(name, text string, max int) (bool, error) {
+	if err := checkTemplateName(name); err != nil {
+		return false, fmt.Errorf("%w: %s", errInvalidTemplate, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.templates[name]; !exists && max > 0 && len(s.templates) >= max {
+		return false, fmt.Errorf("%w: it holds the maximum of %d templates", errStoreFull, max)
+	}
+	templates := make(map[string]string, len(s.templates)+1)
+	for other, text := range s.templates {
+		templates[other] = text
+	}
+	templates[name] = text
+	pt, err := s.e.Parse(sortedTemplates(templates)...)
+	if err != nil {
+		return false, fmt.Errorf("%w %s: %s", errInvalidTemplate, name, err)
+	}
+	if s.dir != "" {
+		fpath := filepath.Join(s.dir, filepath.FromSlash(name))
+		if err := WriteFile(fpath, strings.NewReader(text), WriteOptions{WriteAtomic, 0644, true}); err != nil {
+			return false, err
+		}
+	}
+	_, exists := s.templates[name]
+	s.templates[name] = text
+	s.parsed = pt
+	return !exists, nil
+}
+
+// Delete removes template name, telling whether it existed
+func (s *TemplateStore) Delete(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.templates[name]; !ok {
+		return false, nil
+	}
+	if s.dir != "" {
+		if err := os.Remove(filepath.Join(s.dir, filepath.FromSlash(name))); err != nil && !os.IsNotExist(err) {
+			return true, err
+		}
+	}
+	delete(s.templates, name)
+	s.parsed = nil
+	return true, nil
+}
+
+// Parse returns template name, parsed with all the others so that they can be called from it
+// with {{template "other"}}. The set is parsed once by the store engine, and kept until the store changes.
+// It's rendered as e would: it fails if the template, or those it runs, call functions e doesn't allow.
+func (s *TemplateStore) Parse(e *Engine, name string) (*Parsed, bool, error) {
+	s.mu.RLock()
+	_, ok := s.templates[name]
+	pt := s.parsed
+	s.mu.RUnlock()
+	if !ok {
+		return nil, false, nil
+	}
+	if pt == nil {
+		s.mu.Lock()
+		if pt = s.parsed; pt == nil {
+			var err error
+			if pt, err = s.e.Parse(sortedTemplates(s.templates)...); err != nil {
+				s.mu.Unlock()
+				return nil, true, err
+			}
+			s.parsed = pt
+		}
+		s.mu.Unlock()
+	}
+	if pt, ok = pt.Lookup(name); !ok {
+		return nil, false, nil
+	}
+	if e != s.e {
+		for _, fname := range pt.calls() {
+			if _, ok := s.e.funcs[fname]; !ok {
+				continue // a builtin
+			}
+			if info, ok := e.funcs[fname]; !ok || !e.policy.Allows(fname, info) {
+				return nil, true, fmt.Errorf("template %s: function %s %w", name, fname, errNotAllowed)
+			}
+		}
+	}
+	return pt, true, nil
+}
+
+// sortedTemplates returns templates sorted by name
+func sortedTemplates(templates map[string]string) []Template {
+	out := make([]Template, 0, len(templates))
+	for name, text := range templates {
+		out = append(out, Template{name, text})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// checkTemplateName refuses names that would be files outside of the store directory
+func checkTemplateName(name string) error {
+	if name == "" || path.Clean(name) != name || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") || strings.Contains(name, "\\") {
+		return fmt.Errorf("invalid template name %q", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return fmt.Errorf("invalid template name %q", name)
+		}
+	}
+	return nil
+}
+
+// TemplatesServer manages the templates in s: GET /templates lists them,
+// GET, PUT (with the template text as body) and DELETE /templates/NAME read, store and remove one.
+// Templates are parsed with e, and along with the stored ones, before they're stored.
+func TemplatesServer(e *Engine, s *TemplateStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Noticef("new request ( %s %s ) from %s", r.Method, r.URL, r.RemoteAddr)
+		name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/templates"), "/")
+		switch {
+		case name == "" && r.Method == http.MethodGet:
+			writeJSON(w, r, http.StatusOK, jresp{Status: http.StatusOK, Results: s.Names()})
+		case name == "":
+			writeJSON(w, r, http.StatusMethodNotAllowed, jresp{Status: http.StatusMethodNotAllowed, Error: "use GET"})
+		case r.Method == http.MethodGet:
+			text, ok := s.Get(name)
+			if !ok {
+				writeJSON(w, r, http.StatusNotFound, jresp{Status: http.StatusNotFound, Error: fmt.Sprintf("template %s not found", name)})
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Content-Length", strconv.Itoa(len(text)))
+			io.WriteString(w, text)
+		case r.Method == http.MethodPut:
+			b, err := ioutil.ReadAll(r.Body)
+			if bodyTooLarge(w, r) {
+				return
+			}
+			if err != nil {
+				writeJSON(w, r, http.StatusBadRequest, jresp{Status: http.StatusBadRequest, Error: err.Error()})
+				return
+			}
+			limits := requestLimits(r)
+			if err = limits.checkTemplateSize(name, len(b)); err != nil {
+				tooLarge(w, r, err)
+				return
+			}
+			if err = checkTemplateName(name); err == nil {
+				_, err = requestEngine(e, r).Parse(Template{name, string(b)})
+			}
+			if err != nil {
+				writeJSON(w, r, http.StatusBadRequest, jresp{Status: http.StatusBadRequest, Error: err.Error()})
+				return
+			}
+			max := 0
+			if limits != nil {
+				max = limits.MaxTemplates
+			}
+			created, err := s.Put(name, string(b), max)
+			if errors.Is(err, errStoreFull) {
+				tooLarge(w, r, err)
+				return
+			} else if errors.Is(err, errInvalidTemplate) {
+				writeJSON(w, r, http.StatusBadRequest, jresp{Status: http.StatusBadRequest, Error: err.Error()})
+				return
+			} else if err != nil {
+				log.Errorf("request ( %s %s ) from %s: storing template: %s", r.Method, r.URL, r.RemoteAddr, err)
+				writeJSON(w, r, http.StatusInternalServerError, jresp{Status: http.StatusInternalServerError, Error: err.Error()})
+				return
+			}
+			status := http.StatusOK
+			if created {
+				status = http.StatusCreated
+			}
+			writeJSON(w, r, status, jresp{Status: status, Results: name})
+		case r.Method == http.MethodDelete:
+			found, err := s.Delete(name)
+			switch {
+			case err != nil:
+				log.Errorf("request ( %s %s ) from %s: deleting template: %s", r.Method, r.URL, r.RemoteAddr, err)
+				writeJSON(w, r, http.StatusInternalServerError, jresp{Status: http.StatusInternalServerError, Error: err.Error()})
+			case !found:
+				writeJSON(w, r, http.StatusNotFound, jresp{Status: http.StatusNotFound, Error: fmt.Sprintf("template %s not found", name)})
+			default:
+				writeJSON(w, r, http.StatusOK, jresp{Status: http.StatusOK, Results: name})
+			}
+		default:
+			writeJSON(w, r, http.StatusMethodNotAllowed, jresp{Status: http.StatusMethodNotAllowed, Error: "use GET, PUT or DELETE"})
+		}
+	}
+}
+
+// StoredRenderServer renders the templates of s by name: POST /render/NAME with the data as JSON body.
+// The response is the rendered template, as an attachment named as the outfile query parameter if there's one.
+func StoredRenderServer(e *Engine, s *TemplateStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Noticef("new request ( %s %s ) from %s", r.Method, r.URL, r.RemoteAddr)
+		if r.Method != http.MethodPost {
+			writeJSON(w, r, http.StatusMethodNotAllowed, jresp{Status: http.StatusMethodNotAllowed, Error: "use POST"})
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/render/")
+		tpl, ok, err := s.Parse(requestEngine(e, r), name)
+		if errors.Is(err, errNotAllowed) {
+			log.Warningf("rejected request ( %s %s ) from %s: %s", r.Method, r.URL, r.RemoteAddr, err)
+			writeJSON(w, r, http.StatusForbidden, jresp{Status: http.StatusForbidden, Error: err.Error()})
+			return
+		} else if ok && err != nil {
+			requestMetrics(r).parseError()
+			log.Errorf("request ( %s %s ) from %s: error building template.Template: %s", r.Method, r.URL, r.RemoteAddr, err)
+			writeJSON(w, r, http.StatusInternalServerError, jresp{Status: http.StatusInternalServerError, Error: err.Error()})
+			return
+		}
+		if !ok {
+			writeJSON(w, r, http.StatusNotFound, jresp{Status: http.StatusNotFound, Error: fmt.Sprintf("template %s not found", name)})
+			return
+		}
+		var data interface{}
+		if err = json.NewDecoder(r.Body).Decode(&data); err != nil && err != io.EOF {
+			if bodyTooLarge(w, r) {
+				return
+			}
+			writeJSON(w, r, http.StatusBadRequest, jresp{Status: http.StatusBadRequest, Error: err.Error()})
+			return
+		}
+		buf := new(bytes.Buffer)
+		if err = tpl.Execute(r.Context(), data, buf); err != nil {
+			log.Warningf("error processing request ( %s %s ) from %s: tplog.Execute: %s", r.Method, r.URL, r.RemoteAddr, err)
+			writeJSON(w, r, http.StatusInternalServerError, jresp{Status: http.StatusInternalServerError, Error: err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(buf.Bytes()))
+		if outfile := r.URL.Query().Get("outfile"); outfile != "" {
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", path.Base(outfile)))
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.WriteHeader(http.StatusOK)
+		if _, err = io.Copy(w, buf); err != nil {
+			log.Errorf("error sending response to request ( %s %s ) from %s: %s", r.Method, r.URL, r.RemoteAddr, err)
+		} else {
+			log.Infof("processed request ( %s %s ) from %s", r.Method, r.URL, r.RemoteAddr)
+		}
+	}
+}
+
+// writeJSON sends resp with status
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, resp jresp) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Errorf("error sending response to request ( %s %s ) from %s: %s", r.Method, r.URL, r.RemoteAddr, err)
+	}
+}
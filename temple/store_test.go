@@ -0,0 +1,139 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTemplateStoreParses(t *testing.T) {
+	dir := t.TempDir()
+	for name, text := range map[string]string{"hello": `hello {{template "name" .}}`, "name": `{{.}}`, "broken": `{{if}}`} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := NewEngine()
+	s, err := NewTemplateStore(e, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := strings.Join(s.Names(), ","); names != "hello,name" {
+		t.Fatalf("expected the broken template to be left out, got %s", names)
+	}
+
+	srv := StoredRenderServer(e, s)
+	rec := httptest.NewRecorder()
+	srv(rec, httptest.NewRequest(http.MethodPost, "/render/hello", strings.NewReader(`"world"`)))
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "hello world" {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Body)
+	}
+	first, _, _ := s.Parse(e, "hello")
+	second, _, _ := s.Parse(e, "name")
+	if first.text != second.text {
+		t.Fatal("expected the parsed set to be reused")
+	}
+
+	if _, err = s.Put("broken", `{{end}}`, 0); err == nil {
+		t.Fatal("expected a template that doesn't parse to be refused")
+	}
+	if _, err = s.Put("name", `{{printf "%s!" .}}`, 0); err != nil {
+		t.Fatal(err)
+	}
+	pt, ok, err := s.Parse(e, "hello")
+	if !ok || err != nil {
+		t.Fatalf("expected hello to parse, got %v, %v", ok, err)
+	}
+	buf := new(bytes.Buffer)
+	if err = pt.Execute(context.Background(), "world", buf); err != nil || strings.TrimSpace(buf.String()) != "hello world!" {
+		t.Fatalf("expected the changed template to be used, got %q, %v", buf, err)
+	}
+}
+
+func TestTemplateStoreLimit(t *testing.T) {
+	s, err := NewTemplateStore(NewEngine(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := (&ServerLimits{MaxTemplates: 3}).Limit(TemplatesServer(NewEngine(), s))
+	codes := make(chan int, 20)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			srv(rec, httptest.NewRequest(http.MethodPut, "/templates/t"+strconv.Itoa(i), strings.NewReader("x")))
+			codes <- rec.Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusCreated] != 3 || counts[http.StatusRequestEntityTooLarge] != cap(codes)-3 {
+		t.Fatalf("expected 3 templates stored and the others refused with 413, got %v", counts)
+	}
+	if n := len(s.Names()); n != 3 {
+		t.Fatalf("expected 3 stored templates, got %d", n)
+	}
+}
+
+func TestTemplateStoreUnsafeScope(t *testing.T) {
+	e := NewEngine(WithPolicy(&Policy{Unsafe: true}), WithTracer(func(*Call) {}))
+	s, err := NewTemplateStore(e, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, text := range map[string]string{
+		"safe":     `{{define "part"}}{{upper "ok"}}{{end}}{{template "part"}}`,
+		"unsafe":   `{{(cmd "echo" "ran").Stdout}}`,
+		"indirect": `{{template "unsafe"}}`,
+		"unused":   `{{define "never"}}{{cmd "echo"}}{{end}}{{lower "OK"}}`,
+	} {
+		if _, err = s.Put(name, text, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := []struct {
+		engine *Engine
+		name   string
+		want   string // the output, or the error
+	}{
+		{e.safe(), "safe", "OK"},
+		{e.safe(), "unused", "ok"},
+		{e.safe(), "unsafe", "function cmd not allowed"},
+		{e.safe(), "indirect", "function cmd not allowed"},
+		{e, "unsafe", "ran"},
+		{e, "indirect", "ran"},
+	}
+	for _, c := range cases {
+		pt, ok, err := s.Parse(c.engine, c.name)
+		if !ok {
+			t.Fatalf("%s: not found", c.name)
+		}
+		buf := new(bytes.Buffer)
+		if err == nil {
+			err = pt.Execute(context.Background(), nil, buf)
+		}
+		got := strings.TrimSpace(buf.String())
+		if err != nil {
+			got = err.Error()
+		}
+		if !strings.Contains(got, c.want) {
+			t.Errorf("%s: expected %q, got %q", c.name, c.want, got)
+		}
+	}
+}
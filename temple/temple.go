@@ -6,6 +6,7 @@ package temple
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	htmlTpl "html/template"
 	"os"
@@ -15,18 +16,13 @@ import (
 )
 
 var (
-	DebugHTTPRequests     = false
-	EnableUnsafeFunctions = false
+	DebugHTTPRequests = false
 )
 
-func init() {
-	defaultFnMapHelpText = FnMap.HelpText()
-}
-
-func (t templeFnMap) BuildTemplate(_unsafe bool, name, _template string, loadedFiles map[string]string, localFiles ...string) (*textTpl.Template, []string, error) {
+func (t Functions) BuildTemplate(ctx context.Context, p *Policy, name, _template string, loadedFiles map[string]string, localFiles ...string) (*textTpl.Template, []string, error) {
 	var err error
 	var all []string
-	tpl := textTpl.New(name).Funcs(t.BuildFuncMap(_unsafe))
+	tpl := textTpl.New(name).Funcs(t.BuildFuncMap(ctx, p))
 	if _template != "" {
 		tpl, err = tpl.Parse(_template)
 		if err != nil {
@@ -35,7 +31,11 @@ func (t templeFnMap) BuildTemplate(_unsafe bool, name, _template string, loadedF
 		all = []string{path.Base(name)}
 	}
 	for _, lft := range localFiles {
-		text, err := fload(lft)
+		fpath, err := p.resolve(lft, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		text, err := fload(fpath)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -60,10 +60,10 @@ func (t templeFnMap) BuildTemplate(_unsafe bool, name, _template string, loadedF
 	return tpl, all, nil
 }
 
-func (t templeFnMap) BuildHTMLTemplate(_unsafe bool, name, _template string, loadedFiles map[string]string, localFiles ...string) (*htmlTpl.Template, []string, error) {
+func (t Functions) BuildHTMLTemplate(ctx context.Context, p *Policy, name, _template string, loadedFiles map[string]string, localFiles ...string) (*htmlTpl.Template, []string, error) {
 	var err error
 	var all []string
-	tpl := htmlTpl.New(name).Funcs(t.BuildHTMLFuncMap(_unsafe))
+	tpl := htmlTpl.New(name).Funcs(t.BuildHTMLFuncMap(ctx, p))
 	if _template != "" {
 		tpl, err = tpl.Parse(_template)
 		if err != nil {
@@ -72,7 +72,11 @@ func (t templeFnMap) BuildHTMLTemplate(_unsafe bool, name, _template string, loa
 		all = []string{path.Base(name)}
 	}
 	for _, lft := range localFiles {
-		text, err := fload(lft)
+		fpath, err := p.resolve(lft, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		text, err := fload(fpath)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -0,0 +1,134 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// CertificateSource hands the server certificate to TLS handshakes, it can be swapped while serving
+type CertificateSource struct {
+	certFile, keyFile string
+	cert              *tls.Certificate
+	mu                sync.RWMutex
+}
+
+// LoadCertificate reads the PEM certificate (chain) and key in certFile and keyFile
+func LoadCertificate(certFile, keyFile string) (*CertificateSource, error) {
+	s := &CertificateSource{certFile: certFile, keyFile: keyFile}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SelfSignedCertificate generates a certificate for hosts (names or IP addresses), valid for a year
+func SelfSignedCertificate(hosts ...string) (*CertificateSource, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"xprint self-signed"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+		} else if h != "" {
+			tpl.DNSNames = append(tpl.DNSNames, h)
+		}
+	}
+	if len(tpl.DNSNames) > 0 {
+		tpl.Subject.CommonName = tpl.DNSNames[0]
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CertificateSource{cert: &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}}, nil
+}
+
+// Reload reads the certificate files again, on errors the old certificate stays in use
+func (s *CertificateSource) Reload() error {
+	if s.certFile == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("%s: %w", s.certFile, err)
+	}
+	s.mu.Lock()
+	s.cert = &cert
+	s.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the certificate when its files change, until ctx is done. Reload errors go to onReload, nil on success.
+func (s *CertificateSource) Watch(ctx context.Context, interval time.Duration, onReload func(error)) {
+	if s.certFile == "" {
+		return
+	}
+	for {
+		if _, err := WaitForChanges(ctx, []string{s.certFile, s.keyFile}, interval, interval); err != nil {
+			return
+		}
+		err := s.Reload()
+		if onReload != nil {
+			onReload(err)
+		}
+	}
+}
+
+// Leaf is the certificate in use
+func (s *CertificateSource) Leaf() *x509.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert.Leaf
+}
+
+// GetCertificate is for tls.Config
+func (s *CertificateSource) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, nil
+}
+
+// TLSConfig is a server configuration with the certificate of s
+func (s *CertificateSource) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
@@ -0,0 +1,150 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSelfSignedCertificate(t *testing.T) {
+	cases := []struct {
+		hosts    []string
+		dnsNames []string
+		ips      int
+		cn       string
+	}{
+		{nil, nil, 0, ""},
+		{[]string{"localhost"}, []string{"localhost"}, 0, "localhost"},
+		{[]string{"127.0.0.1", "::1"}, nil, 2, ""},
+		{[]string{"127.0.0.1", "a.example", "", "b.example"}, []string{"a.example", "b.example"}, 1, "a.example"},
+	}
+	for _, c := range cases {
+		s, err := SelfSignedCertificate(c.hosts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf := s.Leaf()
+		if !reflect.DeepEqual(leaf.DNSNames, c.dnsNames) || len(leaf.IPAddresses) != c.ips || leaf.Subject.CommonName != c.cn {
+			t.Fatalf("%v: unexpected certificate for %v %v %q", c.hosts, leaf.DNSNames, leaf.IPAddresses, leaf.Subject.CommonName)
+		}
+		for _, h := range c.hosts {
+			if err = leaf.VerifyHostname(h); h != "" && err != nil {
+				t.Fatalf("%v: %s", c.hosts, err)
+			}
+		}
+	}
+}
+
+// writeCertificate writes a new self-signed certificate and its key as PEM files
+func writeCertificate(t *testing.T, certFile, keyFile string) *x509.Certificate {
+	s, err := SelfSignedCertificate("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := s.GetCertificate(nil)
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := writeCertificate(t, certFile, keyFile)
+	s, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Leaf().Equal(first) {
+		t.Fatal("loaded a different certificate")
+	}
+	second := writeCertificate(t, certFile, keyFile)
+	if err = s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Leaf().Equal(second) {
+		t.Fatal("the certificate wasn't reloaded")
+	}
+	if err = ioutil.WriteFile(keyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Reload(); err == nil {
+		t.Fatal("expected an error reloading a broken key")
+	}
+	if !s.Leaf().Equal(second) {
+		t.Fatal("a failed reload replaced the certificate")
+	}
+	if _, err = LoadCertificate(certFile, keyFile); err == nil {
+		t.Fatal("expected an error loading a broken key")
+	}
+}
+
+func TestCertificateWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile)
+	s, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reloaded := make(chan error, 10)
+	go s.Watch(ctx, 10*time.Millisecond, func(err error) { reloaded <- err })
+	time.Sleep(30 * time.Millisecond) // let the first stamps be taken
+	second := writeCertificate(t, certFile, keyFile)
+	for {
+		select {
+		case err = <-reloaded: // it can fail once, if the certificate is read before the key is written
+		case <-ctx.Done():
+			t.Fatalf("the certificate wasn't reloaded, last error: %v", err)
+		}
+		if err == nil && s.Leaf().Equal(second) {
+			return
+		}
+	}
+}
+
+func TestCertificateServes(t *testing.T) {
+	s, err := SelfSignedCertificate("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	srv.Listener = tls.NewListener(srv.Listener, s.TLSConfig()) // StartTLS would add its own certificate
+	srv.Start()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Leaf())
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := client.Get("https://" + srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if b, _ := ioutil.ReadAll(resp.Body); string(b) != "ok" || resp.TLS == nil || !resp.TLS.PeerCertificates[0].Equal(s.Leaf()) {
+		t.Fatalf("unexpected response %q over %+v", b, resp.TLS)
+	}
+}
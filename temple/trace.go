@@ -0,0 +1,347 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"text/template/parse"
+	"time"
+)
+
+const (
+	TraceNDJSON = "ndjson"
+	TraceChrome = "chrome"
+)
+
+var (
+	traceMaxValue = 1024 // longer strings are cut in traces
+	traceSlowest  = 10   // calls listed in the summary
+)
+
+type (
+	// callSites maps the names function calls are renamed to, one per place they're called from, to where that is
+	callSites map[string]callSite
+	callSite  struct {
+		Function string
+		Template string
+		Position string
+	}
+	// siteError is an execution error mentioning the functions by their name rather than their call site
+	siteError struct {
+		msg string
+		err error
+	}
+	// TraceWriter is a Tracer writing calls and executions to a file, as they happen, and keeping
+	// the slowest ones and the totals per function for a summary
+	TraceWriter struct {
+		format  string
+		w       io.Writer
+		epoch   time.Time
+		n       int
+		slowest []*Call
+		totals  map[string]*traceTotal
+		err     error
+		mu      sync.Mutex
+	}
+	traceTotal struct {
+		Calls int
+		Total time.Duration
+		Max   time.Duration
+	}
+	traceRecord struct {
+		Time     time.Time     `json:"time"`
+		Render   uint64        `json:"render"`
+		Template string        `json:"template,omitempty"`
+		Position string        `json:"position,omitempty"`
+		Function string        `json:"function,omitempty"`
+		Args     []interface{} `json:"args,omitempty"`
+		Output   interface{}   `json:"output,omitempty"`
+		Error    string        `json:"error,omitempty"`
+		Duration float64       `json:"duration_ms"`
+	}
+	// chromeEvent is a complete event of the trace event format, as read by chrome://tracing and Perfetto
+	chromeEvent struct {
+		Name string                 `json:"name"`
+		Cat  string                 `json:"cat"`
+		Ph   string                 `json:"ph"`
+		Ts   float64                `json:"ts"`
+		Dur  float64                `json:"dur"`
+		Pid  int                    `json:"pid"`
+		Tid  uint64                 `json:"tid"`
+		Args map[string]interface{} `json:"args,omitempty"`
+	}
+)
+
+// add renames the calls to functions of t in tree to their call site, and records where they are
+func (s callSites) add(tree *parse.Tree, t Functions) callSites {
+	if tree == nil {
+		return s
+	}
+	if s == nil {
+		s = callSites{}
+	}
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n != nil {
+				for _, x := range n.Nodes {
+					walk(x)
+				}
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n != nil {
+				for _, x := range n.Cmds {
+					walk(x)
+				}
+			}
+		case *parse.CommandNode:
+			for _, x := range n.Args {
+				walk(x)
+			}
+		case *parse.ChainNode:
+			walk(n.Node)
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.TemplateNode:
+			walk(n.Pipe)
+		case *parse.IdentifierNode:
+			if _, ok := t[n.Ident]; !ok {
+				return
+			}
+			location, _ := tree.ErrorContext(n)
+			site := fmt.Sprintf("%s__%d", n.Ident, len(s))
+			for _, taken := t[site]; taken; _, taken = t[site] {
+				site += "_"
+			}
+			s[site] = callSite{n.Ident, tree.Name, location}
+			n.Ident = site
+		}
+	}
+	walk(tree.Root)
+	return s
+}
+
+// tracer tells tracer where the calls come from
+func (s callSite) tracer(tracer Tracer) Tracer {
+	if tracer == nil {
+		return nil
+	}
+	return func(c *Call) {
+		c.Template, c.Position = s.Template, s.Position
+		tracer(c)
+	}
+}
+
+// restore puts the function names back in the message of err
+func (s callSites) restore(err error) error {
+	if err == nil || len(s) < 1 {
+		return err
+	}
+	sites := make([]string, 0, len(s))
+	for site := range s {
+		sites = append(sites, site)
+	}
+	sort.Slice(sites, func(i, j int) bool { return len(sites[i]) > len(sites[j]) }) // fn__12 before fn__1
+	msg := err.Error()
+	for _, site := range sites {
+		msg = strings.ReplaceAll(msg, site, s[site].Function)
+	}
+	return &siteError{msg, err}
+}
+
+func (e *siteError) Error() string { return e.msg }
+
+func (e *siteError) Unwrap() error { return e.err }
+
+// NewTraceWriter returns a TraceWriter writing to w in one of the Trace* formats, Trace is the Tracer
+func NewTraceWriter(w io.Writer, format string) (*TraceWriter, error) {
+	switch format {
+	case TraceNDJSON, "":
+		format = TraceNDJSON
+	case TraceChrome:
+		if _, err := io.WriteString(w, "[\n"); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown trace format %s, use %s or %s", format, TraceNDJSON, TraceChrome)
+	}
+	return &TraceWriter{format: format, w: w, epoch: time.Now(), totals: map[string]*traceTotal{}}, nil
+}
+
+// Trace writes c, the first write error is kept and returned by Close
+func (t *TraceWriter) Trace(c *Call) {
+	var b []byte
+	var err error
+	if t.format == TraceChrome {
+		b, err = json.Marshal(t.chromeEvent(c))
+	} else {
+		b, err = json.Marshal(traceRecordOf(c))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c.Function != "" {
+		t.count(c)
+	}
+	if t.err != nil {
+		return
+	}
+	if err == nil {
+		if t.format == TraceChrome && t.n > 0 {
+			b = append([]byte(",\n"), b...)
+		}
+		_, err = t.w.Write(append(b, '\n'))
+	}
+	t.n++
+	t.err = err
+}
+
+func (t *TraceWriter) count(c *Call) {
+	total, ok := t.totals[c.Function]
+	if !ok {
+		total = &traceTotal{}
+		t.totals[c.Function] = total
+	}
+	total.Calls++
+	total.Total += c.Duration
+	if c.Duration > total.Max {
+		total.Max = c.Duration
+	}
+	i := sort.Search(len(t.slowest), func(i int) bool { return t.slowest[i].Duration < c.Duration })
+	if i >= traceSlowest {
+		return
+	}
+	t.slowest = append(t.slowest, nil)
+	copy(t.slowest[i+1:], t.slowest[i:])
+	t.slowest[i] = c
+	if len(t.slowest) > traceSlowest {
+		t.slowest = t.slowest[:traceSlowest]
+	}
+}
+
+// Close ends the trace, it doesn't close the underlying writer
+func (t *TraceWriter) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil && t.format == TraceChrome {
+		_, t.err = io.WriteString(t.w, "]\n")
+	}
+	return t.err
+}
+
+// WriteSummary writes the slowest calls traced so far and the time spent in each function
+func (t *TraceWriter) WriteSummary(w io.Writer) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SLOWEST CALLS\tDURATION\tWHERE")
+	for _, c := range t.slowest {
+		where := c.Position
+		if where == "" {
+			where = c.Template
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Function, c.Duration, where)
+	}
+	names := make([]string, 0, len(t.totals))
+	for name := range t.totals {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return t.totals[names[i]].Total > t.totals[names[j]].Total })
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FUNCTION\tCALLS\tTOTAL\tMAX")
+	for _, name := range names {
+		x := t.totals[name]
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", name, x.Calls, x.Total, x.Max)
+	}
+	return tw.Flush()
+}
+
+func traceRecordOf(c *Call) traceRecord {
+	r := traceRecord{
+		Time:     c.Start,
+		Render:   c.Render,
+		Template: c.Template,
+		Position: c.Position,
+		Function: c.Function,
+		Output:   traceValue(c.Output),
+		Duration: float64(c.Duration) / float64(time.Millisecond),
+	}
+	for _, a := range c.Args {
+		r.Args = append(r.Args, traceValue(a))
+	}
+	if c.Err != nil {
+		r.Error = c.Err.Error()
+	}
+	return r
+}
+
+func (t *TraceWriter) chromeEvent(c *Call) chromeEvent {
+	ev := chromeEvent{
+		Name: c.Function,
+		Cat:  "function",
+		Ph:   "X",
+		Ts:   float64(c.Start.Sub(t.epoch)) / float64(time.Microsecond),
+		Dur:  float64(c.Duration) / float64(time.Microsecond),
+		Pid:  1,
+		Tid:  c.Render,
+		Args: map[string]interface{}{"template": c.Template},
+	}
+	if c.Function == "" {
+		ev.Name, ev.Cat = c.Template, "template"
+	} else {
+		r := traceRecordOf(c)
+		ev.Args["position"], ev.Args["args"], ev.Args["output"] = r.Position, r.Args, r.Output
+	}
+	if c.Err != nil {
+		ev.Args["error"] = c.Err.Error()
+	}
+	return ev
+}
+
+// traceValue is v as it goes in a trace: long strings are cut and values json can't encode are described by type
+func traceValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case string:
+		if len(x) > traceMaxValue {
+			return fmt.Sprintf("%s... (%d bytes)", x[:traceMaxValue], len(x))
+		}
+		return x
+	case []byte:
+		if len(x) > traceMaxValue {
+			return fmt.Sprintf("%T of %d bytes", x, len(x))
+		}
+		return x
+	case error:
+		return x.Error()
+	}
+	b, err := json.Marshal(v)
+	if err != nil || len(b) > traceMaxValue {
+		return fmt.Sprintf("%T", v)
+	}
+	return json.RawMessage(b)
+}
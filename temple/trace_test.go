@@ -0,0 +1,161 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const traceTestTemplate = "{{upper .}}\n{{define \"x\"}}{{lower .}}{{end}}{{template \"x\" .}}"
+
+func TestTraceNDJSON(t *testing.T) {
+	b := new(bytes.Buffer)
+	tw, err := NewTraceWriter(b, TraceNDJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine(WithTracer(tw.Trace))
+	if err = e.Render(context.Background(), []Template{{"t", traceTestTemplate}}, "Ab", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var got []traceRecord
+	dec := json.NewDecoder(b)
+	for dec.More() {
+		var r traceRecord
+		if err = dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		r.Time, r.Duration = time.Time{}, 0
+		got = append(got, r)
+	}
+	render := got[len(got)-1].Render
+	want := []traceRecord{
+		{Render: render, Template: "t", Position: "t:1:2", Function: "upper", Args: []interface{}{"Ab"}, Output: "AB"},
+		{Render: render, Template: "x", Position: "t:2:16", Function: "lower", Args: []interface{}{"Ab"}, Output: "ab"},
+		{Render: render, Template: "t"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestTraceChrome(t *testing.T) {
+	b := new(bytes.Buffer)
+	tw, err := NewTraceWriter(b, TraceChrome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine(WithTracer(tw.Trace))
+	for i := 0; i < 2; i++ {
+		if err = e.Render(context.Background(), []Template{{"t", traceTestTemplate}}, "Ab", ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var events []chromeEvent
+	if err = json.Unmarshal(b.Bytes(), &events); err != nil {
+		t.Fatalf("the trace isn't a json array: %s\n%s", err, b)
+	}
+	var names []string
+	for i, ev := range events {
+		names = append(names, ev.Cat+":"+ev.Name)
+		if ev.Ph != "X" || ev.Tid != events[i/3*3].Tid { // one thread per render
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	}
+	want := "function:upper function:lower template:t function:upper function:lower template:t"
+	if strings.Join(names, " ") != want || events[0].Tid == events[3].Tid {
+		t.Fatalf("expected %s in two renders, got %+v", want, events)
+	}
+}
+
+func TestTraceErrorNamesFunctions(t *testing.T) {
+	funcs := FnMap.Clone()
+	if err := funcs.Register("fail", Function{Fn: func() (string, error) { return "", errors.New("failed") }}); err != nil {
+		t.Fatal(err)
+	}
+	tw, err := NewTraceWriter(ioutil.Discard, TraceNDJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = NewEngine(WithFunctions(funcs), WithTracer(tw.Trace)).Render(context.Background(), []Template{{"t", `{{fail}}`}}, nil, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), `calling fail: failed`) {
+		t.Fatalf("expected the error to name fail, got %v", err)
+	}
+}
+
+func TestTraceSummary(t *testing.T) {
+	defer func(n int) { traceSlowest = n }(traceSlowest)
+	traceSlowest = 2
+	tw, err := NewTraceWriter(ioutil.Discard, TraceNDJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*Call{
+		{Function: "a", Duration: 1 * time.Millisecond, Position: "t:1:1"},
+		{Function: "b", Duration: 5 * time.Millisecond, Position: "t:1:2"},
+		{Function: "a", Duration: 3 * time.Millisecond, Position: "t:1:3"},
+		{Function: "a", Duration: 3 * time.Millisecond, Template: "u"},
+		{Template: "t", Duration: time.Second}, // executions aren't counted
+	} {
+		tw.Trace(c)
+	}
+	b := new(strings.Builder)
+	if err = tw.WriteSummary(b); err != nil {
+		t.Fatal(err)
+	}
+	want := `SLOWEST CALLS  DURATION  WHERE
+b              5ms       t:1:2
+a              3ms       t:1:3
+
+FUNCTION  CALLS  TOTAL  MAX
+a         3      7ms    3ms
+b         1      5ms    5ms
+`
+	if b.String() != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, b)
+	}
+}
+
+func TestTraceValue(t *testing.T) {
+	defer func(n int) { traceMaxValue = n }(traceMaxValue)
+	traceMaxValue = 4
+	cases := []struct {
+		v, want interface{}
+	}{
+		{nil, nil},
+		{"abcd", "abcd"},
+		{"abcde", "abcd... (5 bytes)"},
+		{[]byte("ab"), []byte("ab")},
+		{[]byte("abcde"), "[]uint8 of 5 bytes"},
+		{errors.New("e"), "e"},
+		{1, json.RawMessage("1")},
+		{[]int{1, 2, 3}, "[]int"},
+		{make(chan int), "chan int"},
+	}
+	for _, c := range cases {
+		if got := traceValue(c.v); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%#v: expected %#v, got %#v", c.v, c.want, got)
+		}
+	}
+}
+
+func TestTraceFormat(t *testing.T) {
+	if _, err := NewTraceWriter(ioutil.Discard, "xml"); err == nil || !strings.Contains(err.Error(), "unknown trace format xml") {
+		t.Fatalf("expected an unknown format error, got %v", err)
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/szampardi/msg"
@@ -19,7 +21,7 @@ type (
 		F      string        `json:"function"`
 		Args   []interface{} `json:"args,omitempty"`
 		Output interface{}   `json:"output,omitempty"`
-		Err    error         `json:"error,omitempty"`
+		Err    string        `json:"error,omitempty"`
 	}
 )
 
@@ -28,18 +30,27 @@ var (
 	startTracingOnce  sync.Once
 	debugAllFunctions                 = false
 	Tracking          *sync.WaitGroup = &sync.WaitGroup{}
+	trackingStarted   int32           // nobody reads fnTrackChan before StartTracking
+	builtins          Functions       // FnMap, for the redaction of tracked calls. set by init, FnMap refers to trackUsage
 )
 
 func trackUsage(_fn string, alwaysTrack bool, output interface{}, err error, args ...interface{}) {
-	if debugAllFunctions || alwaysTrack {
+	if atomic.LoadInt32(&trackingStarted) == 1 && (debugAllFunctions || alwaysTrack) {
 		Tracking.Add(1)
-		fnTrackChan <- &fnTrack{
+		if v := reflect.ValueOf(output); v.Kind() == reflect.Ptr && !v.IsNil() && v.Elem().Kind() != reflect.Struct {
+			output = v.Elem().Interface() // functions pass &out to defer, it's set by the time they return
+		}
+		args, output = builtins[_fn].redact(args, output)
+		x := &fnTrack{
 			T:      time.Now(),
 			F:      _fn,
 			Args:   args[:],
 			Output: fmt.Sprintf("%#v", output),
-			Err:    err,
 		}
+		if err != nil {
+			x.Err = err.Error()
+		}
+		fnTrackChan <- x
 	}
 }
 
@@ -56,7 +67,10 @@ func usageDebugger() {
 
 func StartTracking() {
 	debugAllFunctions = true
-	startTracingOnce.Do(usageDebugger)
+	startTracingOnce.Do(func() {
+		usageDebugger()
+		atomic.StoreInt32(&trackingStarted, 1)
+	})
 }
 
 func StopTracking() {
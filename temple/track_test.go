@@ -0,0 +1,73 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// tracked renders text and returns the calls trackUsage sent, as usageDebugger logs them with -D
+func tracked(t *testing.T, e *Engine, text string, data interface{}) []string {
+	atomic.StoreInt32(&trackingStarted, 1)
+	defer atomic.StoreInt32(&trackingStarted, 0)
+	done := make(chan error)
+	go func() {
+		done <- e.Render(context.Background(), []Template{{"tracked", text}}, data, new(bytes.Buffer))
+	}()
+	var out []string
+	for {
+		select {
+		case x := <-fnTrackChan:
+			j, _ := json.Marshal(x)
+			out = append(out, string(j))
+			Tracking.Done()
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return out
+		}
+	}
+}
+
+func TestTrackUsageRedacts(t *testing.T) {
+	const token = "Bearer t0k3n-never-logged"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	e := NewEngine(WithPolicy(&Policy{Unsafe: true}))
+	cases := []struct {
+		name, text string
+		shown      []string
+		hidden     []string
+	}{
+		{"http headers", `{{(http "POST" .URL "the-body" .Headers).StatusCode}}`, []string{`"http"`, `"POST"`, `"the-body"`, Redacted}, []string{"t0k3n"}},
+		{"encrypt key", `{{encrypt "plaintext" "MDEyMzQ1Njc4OWFiY2RlZg==" ""}}`, []string{`"encrypt"`, Redacted}, []string{"plaintext", "MDEyMzQ1Njc4OWFiY2RlZg=="}},
+		{"secret", `{{tojson (secret "hush")}}`, []string{`"tojson"`}, []string{"hush"}},
+	}
+	data := map[string]interface{}{"URL": srv.URL, "Headers": map[string]string{"Authorization": token}}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			debugAllFunctions = true
+			defer func() { debugAllFunctions = false }()
+			logged := strings.Join(tracked(t, e, c.text, data), "\n")
+			for _, s := range c.shown {
+				if !strings.Contains(logged, s) {
+					t.Errorf("expected %s in:\n%s", s, logged)
+				}
+			}
+			for _, s := range c.hidden {
+				if strings.Contains(logged, s) {
+					t.Errorf("%s logged in:\n%s", s, logged)
+				}
+			}
+		})
+	}
+}
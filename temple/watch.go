@@ -0,0 +1,63 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"context"
+	"os"
+	"sort"
+	"time"
+)
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+	exists  bool
+}
+
+func stampFiles(files []string) map[string]fileStamp {
+	out := make(map[string]fileStamp, len(files))
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			out[f] = fileStamp{}
+			continue
+		}
+		out[f] = fileStamp{info.ModTime(), info.Size(), info.Mode(), true}
+	}
+	return out
+}
+
+// WaitForChanges polls files every interval until at least one of them is created, modified or removed,
+// then keeps polling until they stay unchanged for debounce. It returns the files that changed, or ctx's error once it's done.
+func WaitForChanges(ctx context.Context, files []string, interval, debounce time.Duration) ([]string, error) {
+	last := stampFiles(files)
+	changed := map[string]bool{}
+	var quietSince time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+		now := stampFiles(files)
+		for f, s := range now {
+			if s != last[f] {
+				changed[f] = true
+				quietSince = time.Now()
+			}
+		}
+		last = now
+		if len(changed) > 0 && time.Since(quietSince) >= debounce {
+			break
+		}
+	}
+	out := make([]string, 0, len(changed))
+	for f := range changed {
+		out = append(out, f)
+	}
+	sort.Strings(out)
+	return out, nil
+}
@@ -0,0 +1,81 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package temple
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWaitForChanges(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	cases := []struct {
+		name   string
+		change func() error
+		want   []string
+	}{
+		{"none", func() error { return nil }, nil},
+		{"create", func() error { return ioutil.WriteFile(a, []byte("a"), 0644) }, []string{a}},
+		{"modify", func() error { return ioutil.WriteFile(a, []byte("aa"), 0644) }, []string{a}},
+		{"chmod", func() error { return os.Chmod(a, 0600) }, []string{a}},
+		{"remove", func() error { return os.Remove(a) }, []string{a}},
+		{"both", func() error {
+			if err := ioutil.WriteFile(a, []byte("a"), 0644); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(b, []byte("b"), 0644)
+		}, []string{a, b}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			done := make(chan struct{})
+			var got []string
+			var err error
+			go func() {
+				defer close(done)
+				got, err = WaitForChanges(ctx, []string{a, b}, 10*time.Millisecond, 50*time.Millisecond)
+			}()
+			time.Sleep(30 * time.Millisecond) // let the first stamps be taken
+			if err := c.change(); err != nil {
+				t.Fatal(err)
+			}
+			<-done
+			switch {
+			case c.want == nil && err != context.DeadlineExceeded:
+				t.Fatalf("expected to wait until the deadline, got %v %v", got, err)
+			case c.want != nil && (err != nil || !reflect.DeepEqual(got, c.want)):
+				t.Fatalf("expected %v, got %v %v", c.want, got, err)
+			}
+		})
+	}
+}
+
+func TestWaitForChangesDebounce(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "f")
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+				ioutil.WriteFile(f, make([]byte, i), 0644)
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if got, err := WaitForChanges(ctx, []string{f}, 10*time.Millisecond, 100*time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatalf("expected no result while the file keeps changing, got %v %v", got, err)
+	}
+}
@@ -0,0 +1,346 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/szampardi/xprint/temple"
+	"gopkg.in/yaml.v3"
+)
+
+const testSuffix = ".test.yaml"
+
+// testSpec describes a test case, read from NAME.test.yaml. Paths are relative to its directory.
+type testSpec struct {
+	Template  string                 `yaml:"template"`  // inline template
+	Templates []string               `yaml:"templates"` // template files, the first one is executed. without either, NAME + -suffix
+	Data      map[string]interface{} `yaml:"data"`
+	DataFiles []string               `yaml:"datafiles"` // deep-merged over data, in order
+	Args      []string               `yaml:"args"`
+	Stdin     string                 `yaml:"stdin"`
+	Input     string                 `yaml:"input"`    // parse stdin into .Input, as with -i
+	Policy    string                 `yaml:"policy"`   // policy file to use instead of the command line one
+	Cassette  string                 `yaml:"cassette"` // replay side-effecting functions from this cassette
+	HTML      bool                   `yaml:"html"`
+	Output    *string                `yaml:"output"` // expected output, instead of a golden file
+	Golden    string                 `yaml:"golden"` // file with the expected output, NAME.golden by default
+	Error     string                 `yaml:"error"`  // the render is expected to fail with an error containing this
+}
+
+// xprint test [flags] [DIR...]
+func runTests(ctx context.Context) error {
+	dirs := data.Args
+	if len(dirs) < 1 {
+		dirs = []string{"."}
+	}
+	var specs []string
+	for _, dir := range dirs {
+		found, err := findTests(dir)
+		if err != nil {
+			return err
+		}
+		specs = append(specs, found...)
+	}
+	if len(specs) < 1 {
+		return fmt.Errorf("no *%s files found in %v", testSuffix, dirs)
+	}
+	failed := 0
+	for _, spec := range specs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		name := strings.TrimSuffix(spec, testSuffix)
+		start := time.Now()
+		msg, err := runTest(ctx, spec)
+		elapsed := time.Since(start).Round(time.Millisecond)
+		switch {
+		case err != nil:
+			failed++
+			fmt.Printf("FAIL\t%s\t%s\n%s\n", name, elapsed, strings.TrimSuffix(err.Error(), "\n"))
+		case msg != "":
+			fmt.Printf("ok\t%s\t%s\t(%s)\n", name, elapsed, msg)
+		default:
+			fmt.Printf("ok\t%s\t%s\n", name, elapsed)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d test(s) failed", failed, len(specs))
+	}
+	return nil
+}
+
+// findTests lists the test specs under dir, recursively
+func findTests(dir string) ([]string, error) {
+	var out []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(p, testSuffix) {
+			out = append(out, p)
+		}
+		return nil
+	})
+	sort.Strings(out)
+	return out, err
+}
+
+// runTest renders the test case in spec and compares the result with the expected output,
+// a mismatch is returned as an error with the unified diff
+func runTest(ctx context.Context, spec string) (string, error) {
+	b, err := ioutil.ReadFile(spec)
+	if err != nil {
+		return "", err
+	}
+	var t testSpec
+	if err = yaml.Unmarshal(b, &t); err != nil {
+		return "", fmt.Errorf("%s: %w", spec, err)
+	}
+	dir := filepath.Dir(spec)
+	name := strings.TrimSuffix(filepath.Base(spec), testSuffix)
+	rel := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	p := policy
+	if t.Policy != "" {
+		if p, err = temple.LoadPolicy(rel(t.Policy)); err != nil {
+			return "", err
+		}
+	}
+	opts := []temple.Option{temple.WithFunctions(functions), temple.WithPolicy(p), temple.WithHTML(*isHTML || t.HTML)}
+	var c *temple.Cassette
+	if t.Cassette != "" {
+		if c, err = temple.OpenCassette(rel(t.Cassette), temple.CassetteReplay); err != nil {
+			return "", err
+		}
+		opts = append(opts, temple.WithCassette(c))
+	}
+	e := temple.NewEngine(opts...)
+	var templates []temple.Template
+	switch {
+	case t.Template != "":
+		templates = append(templates, temple.Template{Name: name, Text: t.Template})
+	case len(t.Templates) < 1:
+		t.Templates = []string{name + *tplSuffix}
+	}
+	for _, f := range t.Templates {
+		loaded, err := e.Load(rel(f))
+		if err != nil {
+			return "", err
+		}
+		templates = append(templates, loaded...)
+	}
+	td := templateData{Args: t.Args, Stdin: t.Stdin, Data: t.Data}
+	for _, f := range t.DataFiles {
+		m, err := temple.LoadDataFile(rel(f))
+		if err != nil {
+			return "", err
+		}
+		td.Data = temple.MergeData(td.Data, m)
+	}
+	if t.Input != "" {
+		if td.Input, err = temple.ParseInput([]byte(t.Stdin), t.Input); err != nil {
+			return "", fmt.Errorf("parsing stdin: %w", err)
+		}
+	}
+	buf := new(bytes.Buffer)
+	err = e.Render(ctx, templates, td, buf)
+	if t.Error != "" {
+		if err == nil {
+			return "", fmt.Errorf("expected an error containing %q, got none", t.Error)
+		} else if !strings.Contains(err.Error(), t.Error) {
+			return "", fmt.Errorf("expected an error containing %q, got: %s", t.Error, err)
+		}
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if c != nil {
+		if unused := c.Unused(); len(unused) > 0 {
+			return "", fmt.Errorf("calls not replayed from %s: %s", t.Cassette, strings.Join(unused, ", "))
+		}
+	}
+	if t.Output != nil {
+		if *update {
+			return "inline output not updated", checkOutput("output", *t.Output, buf.String())
+		}
+		return "", checkOutput("output", *t.Output, buf.String())
+	}
+	golden := rel(t.Golden)
+	if golden == "" {
+		golden = filepath.Join(dir, name+".golden")
+	}
+	want, err := ioutil.ReadFile(golden)
+	if *update {
+		if err == nil && bytes.Equal(want, buf.Bytes()) {
+			return "", nil
+		}
+		return "updated " + golden, temple.WriteFile(golden, bytes.NewReader(buf.Bytes()), temple.WriteOptions{Mode: temple.WriteAtomic, Perm: 0644})
+	}
+	if err != nil {
+		return "", err
+	}
+	return "", checkOutput(golden, string(want), buf.String())
+}
+
+// checkOutput returns the diff between want and got as an error, if they differ
+func checkOutput(name, want, got string) error {
+	if want == got {
+		return nil
+	}
+	return fmt.Errorf("%s", unifiedDiff(name, "rendered", want, got, 3))
+}
+
+type diffLine struct {
+	op   byte // ' ', '-' or '+'
+	text string
+}
+
+// maxDiffCells bounds the size of the table diffLines compares the changed lines with
+const maxDiffCells = 1 << 22
+
+// unifiedDiff compares a and b line by line, with context lines around the changes
+func unifiedDiff(nameA, nameB, a, b string, context int) string {
+	lines, ok := diffLines(strings.SplitAfter(a, "\n"), strings.SplitAfter(b, "\n"))
+	if !ok {
+		return fmt.Sprintf("%s and %s differ, in too many lines to show how\n", nameA, nameB)
+	}
+	posA, posB := make([]int, len(lines)+1), make([]int, len(lines)+1)
+	for i, dl := range lines {
+		posA[i+1], posB[i+1] = posA[i], posB[i]
+		if dl.op != '+' {
+			posA[i+1]++
+		}
+		if dl.op != '-' {
+			posB[i+1]++
+		}
+	}
+	out := new(strings.Builder)
+	fmt.Fprintf(out, "--- %s\n+++ %s\n", nameA, nameB)
+	for i := 0; i < len(lines); {
+		if lines[i].op == ' ' {
+			i++
+			continue
+		}
+		start, end := i-context, i
+		if start < 0 {
+			start = 0
+		}
+		for end < len(lines) {
+			if lines[end].op != ' ' {
+				end++
+				continue
+			}
+			same := 0
+			for end+same < len(lines) && lines[end+same].op == ' ' {
+				same++
+			}
+			if end+same == len(lines) || same > 2*context {
+				if same > context {
+					same = context
+				}
+				end += same
+				break
+			}
+			end += same
+		}
+		fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(posA[start], posA[end]), hunkRange(posB[start], posB[end]))
+		for _, dl := range lines[start:end] {
+			out.WriteByte(dl.op)
+			out.WriteString(dl.text)
+			if !strings.HasSuffix(dl.text, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return out.String()
+}
+
+func hunkRange(from, to int) string {
+	if to-from == 1 {
+		return fmt.Sprint(from + 1)
+	}
+	if to == from {
+		return fmt.Sprintf("%d,0", from)
+	}
+	return fmt.Sprintf("%d,%d", from+1, to-from)
+}
+
+// diffLines finds the shortest edit from a to b through the longest common subsequence of the lines
+// between their common prefix and suffix, false if there are too many of them
+func diffLines(a, b []string) ([]diffLine, bool) {
+	if len(a) > 0 && a[len(a)-1] == "" {
+		a = a[:len(a)-1]
+	}
+	if len(b) > 0 && b[len(b)-1] == "" {
+		b = b[:len(b)-1]
+	}
+	var prefix, suffix []diffLine
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		prefix = append(prefix, diffLine{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		suffix = append(suffix, diffLine{' ', a[len(a)-1]})
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+	if (len(a)+1)*(len(b)+1) > maxDiffCells {
+		return nil, false
+	}
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	out := prefix
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, diffLine{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, diffLine{'-', a[i]})
+			i++
+		default:
+			out = append(out, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, diffLine{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		out = append(out, diffLine{'+', b[j]})
+	}
+	for k := len(suffix) - 1; k >= 0; k-- {
+		out = append(out, suffix[k])
+	}
+	return out, true
+}
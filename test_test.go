@@ -0,0 +1,66 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	cases := []struct {
+		name    string
+		a, b    string
+		context int
+		want    []string // lines after the --- and +++ ones
+	}{
+		{"single line", "a\nb\nc\n", "a\nB\nc\n", 3, []string{"@@ -1,3 +1,3 @@", " a", "-b", "+B", " c"}},
+		{"merged context", "1\n2\n3\n4\n5\n6\n7\n8\n", "1\nx\n3\n4\ny\n6\n7\n8\n", 1, []string{"@@ -1,6 +1,6 @@", " 1", "-2", "+x", " 3", " 4", "-5", "+y", " 6"}},
+		{"separate hunks", "1\n2\n3\n4\n5\n6\n7\n8\n", "1\nx\n3\n4\n5\ny\n7\n8\n", 1, []string{"@@ -1,3 +1,3 @@", " 1", "-2", "+x", " 3", "@@ -5,3 +5,3 @@", " 5", "-6", "+y", " 7"}},
+		{"insert", "a\nb\n", "a\nx\nb\n", 0, []string{"@@ -1,0 +2 @@", "+x"}},
+		{"delete", "a\nx\nb\n", "a\nb\n", 0, []string{"@@ -2 +1,0 @@", "-x"}},
+		{"from empty", "", "a\n", 3, []string{"@@ -0,0 +1 @@", "+a"}},
+		{"no newline", "a\nb", "a\nc", 3, []string{"@@ -1,2 +1,2 @@", " a", "-b", `\ No newline at end of file`, "+c", `\ No newline at end of file`}},
+		{"newline added", "a\nb", "a\nb\n", 3, []string{"@@ -1,2 +1,2 @@", " a", "-b", `\ No newline at end of file`, "+b"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			want := "--- a\n+++ b\n" + strings.Join(c.want, "\n") + "\n"
+			if got := unifiedDiff("a", "b", c.a, c.b, c.context); got != want {
+				t.Fatalf("expected\n%s\ngot\n%s", want, got)
+			}
+		})
+	}
+}
+
+func TestHunkRange(t *testing.T) {
+	cases := []struct {
+		from, to int
+		want     string
+	}{
+		{0, 1, "1"},
+		{4, 5, "5"},
+		{0, 3, "1,3"},
+		{2, 2, "2,0"},
+		{0, 0, "0,0"},
+	}
+	for _, c := range cases {
+		if got := hunkRange(c.from, c.to); got != c.want {
+			t.Errorf("hunkRange(%d, %d): expected %q, got %q", c.from, c.to, c.want, got)
+		}
+	}
+}
+
+func TestDiffLinesTooLarge(t *testing.T) {
+	a, b := make([]string, 3000), make([]string, 3000)
+	for i := range a {
+		a[i], b[i] = "a\n", "b\n"
+	}
+	if _, ok := diffLines(a, b); ok {
+		t.Fatal("expected too many lines to compare")
+	}
+	if got := unifiedDiff("a", "b", strings.Join(a, ""), strings.Join(b, ""), 3); got != "a and b differ, in too many lines to show how\n" {
+		t.Fatalf("unexpected diff %q", got)
+	}
+}
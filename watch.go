@@ -0,0 +1,77 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/szampardi/xprint/temple"
+)
+
+const watchInterval = 250 * time.Millisecond
+
+var (
+	filesRead   = map[string]bool{}
+	filesReadMu sync.Mutex
+)
+
+// watchRender renders again every time a template, a data file or a file read by the last render changes, until ctx is done.
+// Every render is written as the first one, in the -om mode.
+func watchRender(ctx context.Context) {
+	for {
+		changed, err := temple.WaitForChanges(ctx, watchedFiles(), watchInterval, *debounce)
+		if err != nil {
+			return
+		}
+		l.Noticef("changed: %v, rendering again", changed)
+		if data.Data, err = loadData(); err != nil {
+			l.Errorf("loading data: %s", err)
+			continue
+		}
+		buf, err := render(ctx)
+		if err != nil {
+			l.Errorf("rendering: %s", err)
+			continue
+		}
+		afterRender(ctx, emit(buf))
+	}
+}
+
+func watchedFiles() []string {
+	var files []string
+	for _, t := range _templates {
+		if t.IsFile {
+			files = append(files, t.S)
+		}
+	}
+	for _, df := range _dataFiles {
+		files = append(files, df.Path)
+	}
+	filesReadMu.Lock()
+	defer filesReadMu.Unlock()
+	for f := range filesRead {
+		files = append(files, f)
+	}
+	return files
+}
+
+// trackFilesRead is the engine tracer with -w, it records the files read by template functions
+func trackFilesRead(c *temple.Call) {
+	if (c.Function != "rawfile" && c.Function != "textfile") || len(c.Args) < 1 {
+		return
+	}
+	if p, ok := c.Args[0].(string); ok {
+		filesReadMu.Lock()
+		filesRead[p] = true
+		filesReadMu.Unlock()
+	}
+}
+
+func resetFilesRead() {
+	filesReadMu.Lock()
+	filesRead = map[string]bool{}
+	filesReadMu.Unlock()
+}
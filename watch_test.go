@@ -0,0 +1,57 @@
+// COPYRIGHT (c) 2019-2021 SILVANO ZAMPARDI, ALL RIGHTS RESERVED.
+// The license for these sources can be found in the LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/szampardi/xprint/temple"
+)
+
+func TestWatchedFiles(t *testing.T) {
+	dir := t.TempDir()
+	tmpl, dataFile, read := filepath.Join(dir, "t.tmpl"), filepath.Join(dir, "data.json"), filepath.Join(dir, "read.txt")
+	files := map[string]string{
+		tmpl:     `{{textfile .Data.file}} {{rawfile .Data.file | len}}`,
+		dataFile: `{"file": "` + read + `"}`,
+		read:     "read",
+	}
+	for name, text := range files {
+		if err := ioutil.WriteFile(name, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	engine = temple.NewEngine(temple.WithPolicy(&temple.Policy{Unsafe: true}), temple.WithTracer(trackFilesRead))
+	_templates = []struct {
+		S      string
+		IsFile bool
+	}{{"not a file", false}, {tmpl, true}}
+	_dataFiles = []struct {
+		Name string
+		Path string
+	}{{"", dataFile}}
+	defer func() { engine, _templates, _dataFiles, data.Data = nil, nil, nil, nil; resetFilesRead() }()
+	var err error
+	if data.Data, err = loadData(); err != nil {
+		t.Fatal(err)
+	}
+	resetFilesRead()
+	if _, err = render(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := watchedFiles()
+	sort.Strings(got)
+	if want := []string{dataFile, read, tmpl}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	resetFilesRead()
+	if got, want := watchedFiles(), []string{tmpl, dataFile}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v after a reset, got %v", want, got)
+	}
+}